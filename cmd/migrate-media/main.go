@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+
+	"messenger-service/database"
+)
+
+// Move media content left in Postgres rows to the configured blob store,
+// safe to run again after a failure
+func main() {
+	log.SetPrefix("migrate-media: ")
+
+	database.PostgresConnect()
+	database.BlobConnect()
+
+	moved, err := database.BlobMigrate()
+	if err != nil {
+		log.Fatalf("Moved %d blobs before failure: %v", moved, err)
+	}
+
+	log.Printf("Moved %d blobs", moved)
+}
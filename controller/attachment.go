@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"messenger-service/config"
+	"messenger-service/database"
+	"messenger-service/model"
+	"messenger-service/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Max length of stored filename in bytes
+const MessengerAttachmentFilenameLength = 255
+
+// Lifetime of uploaded file which is not sent in any message
+const MessengerAttachmentExpire = 24 * time.Hour
+
+// Interval of removing unsent files
+const MessengerAttachmentCleanupInterval = time.Hour
+
+var ErrMessengerChecksum = errors.New("checksum mismatch")
+
+type MessengerAttachment struct {
+	Id       string `json:"id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Url      string `json:"url,omitempty"`
+}
+
+// Store uploaded file, the returned id is sent as data of a file message
+func MessengerAttachmentUpload(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	owner, _ := strconv.Atoi(claims["id"].(string))
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	if limit := MessengerAttachmentSize(); limit > 0 && file.Size > limit {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"status":  "error",
+			"message": "File is too large",
+			"data":    nil,
+		})
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+	defer content.Close()
+
+	attachment, err := MessengerAttachmentStore(owner, file.Filename, content, file.Size, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewMessengerAttachment(attachment),
+	})
+}
+
+// File behind a signed url, see MessengerAttachmentUrl; a byte range may be requested
+// so interrupted downloads can be resumed
+func MessengerAttachmentDownload(c *fiber.Ctx) error {
+	attachment := new(model.MessengerAttachment)
+	if err := database.Postgres.Where("uid = ?", c.Params("uid")).First(&attachment).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "File not found",
+			"data":    nil,
+		})
+	}
+
+	c.Set("Content-Type", attachment.MimeType)
+	c.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	c.Set("X-Content-Type-Options", "nosniff")
+	return messengerBlobSend(c, attachment.Key, attachment.Size)
+}
+
+// Put the content to the blob store and keep it as file of the owner, content type is sniffed
+// as the one declared by the client is not trusted; with checksum given the content must match it,
+// the same content uploaded again shares the stored blob
+func MessengerAttachmentStore(owner int, filename string, content io.Reader, size int64, checksum string) (model.MessengerAttachment, error) {
+	reader := bufio.NewReader(content)
+	head, err := reader.Peek(512)
+	if err != nil && err != io.EOF {
+		return model.MessengerAttachment{}, err
+	}
+
+	attachment := model.MessengerAttachment{
+		Uid:      utils.RandomId(),
+		UserID:   owner,
+		Filename: MessengerAttachmentFilename(filename),
+		MimeType: http.DetectContentType(head),
+		Size:     size,
+	}
+	attachment.Key, attachment.Checksum, err = MessengerBlobPut("attachment", reader, attachment.Size, checksum)
+	if err != nil {
+		return model.MessengerAttachment{}, err
+	}
+
+	if err := database.Postgres.Create(&attachment).Error; err != nil {
+		MessengerBlobRelease(attachment.Key)
+		return model.MessengerAttachment{}, err
+	}
+
+	return attachment, nil
+}
+
+// Max size of uploaded file in bytes, 0 to rely on the request body limit only
+func MessengerAttachmentSize() int64 {
+	size, _ := strconv.ParseInt(config.Config("MESSENGER_ATTACHMENT_SIZE"), 10, 64)
+	return size * 1024 * 1024
+}
+
+// Base name of the uploaded file without control characters, cut to the max length
+func MessengerAttachmentFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+	name = strings.TrimSpace(name)
+
+	for len(name) > MessengerAttachmentFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// Remove file which is not referenced by file or voice messages anymore
+func MessengerAttachmentRelease(uid string) {
+	var count int64
+	database.Postgres.Model(&model.MessengerMessage{}).Where("type IN ? AND data = ?", []string{"file", "voice"}, uid).Count(&count)
+	if count == 0 {
+		attachment := new(model.MessengerAttachment)
+		if err := database.Postgres.Where("uid = ?", uid).First(&attachment).Error; err != nil {
+			return
+		}
+		database.Postgres.Unscoped().Delete(&attachment)
+		MessengerBlobRelease(attachment.Key)
+	}
+}
+
+// Remove files not sent in any message within their lifetime periodically, every node may run it
+func MessengerAttachmentCleanup() {
+	for range time.Tick(MessengerAttachmentCleanupInterval) {
+		uids := []string{}
+		database.Postgres.
+			Model(&model.MessengerAttachment{}).
+			Where("created_at < ?", time.Now().Add(-MessengerAttachmentExpire)).
+			Where(
+				"uid NOT IN (?)",
+				database.Postgres.Model(&model.MessengerMessage{}).Select("data").Where("type IN ?", []string{"file", "voice"}),
+			).
+			Pluck("uid", &uids)
+		for _, uid := range uids {
+			MessengerAttachmentRelease(uid)
+		}
+	}
+}
+
+// Message metadata describing the file, kept with the message so forwards carry it along,
+// the url is signed for the viewer and is not stored
+func MessengerAttachmentMetadata(attachment model.MessengerAttachment) string {
+	metadata := NewMessengerAttachment(attachment)
+	metadata.Url = ""
+	encoded, _ := json.Marshal(metadata)
+	return string(encoded)
+}
+
+func NewMessengerAttachment(attachment model.MessengerAttachment) MessengerAttachment {
+	return MessengerAttachment{
+		Id:       attachment.Uid,
+		Filename: attachment.Filename,
+		MimeType: attachment.MimeType,
+		Size:     attachment.Size,
+		Checksum: attachment.Checksum,
+		Url:      MessengerAttachmentUrl(attachment.Uid),
+	}
+}
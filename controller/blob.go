@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"messenger-service/database"
+	"messenger-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Interval of removing unreferenced blobs
+const MessengerBlobCleanupInterval = time.Hour
+
+// Put the content to the blob store under the prefix and take a reference to it, content
+// stored before is kept once and the new copy is dropped; with checksum given the content
+// must match it. Returns the key of the stored content with its SHA-256 checksum
+func MessengerBlobPut(prefix string, content io.Reader, size int64, checksum string) (string, string, error) {
+	hash := sha256.New()
+	key := database.BlobKey(prefix)
+	if err := database.Blob.Put(key, io.TeeReader(content, hash), size); err != nil {
+		return "", "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != "" && !strings.EqualFold(checksum, sum) {
+		database.Blob.Delete(key)
+		return "", "", ErrMessengerChecksum
+	}
+
+	shared, err := messengerBlobRegister(sum, key, size)
+	if err != nil || shared != key {
+		database.Blob.Delete(key)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return shared, sum, nil
+}
+
+// Same as MessengerBlobPut for content in memory, nothing is written when it is stored already
+func MessengerBlobPutBytes(prefix string, raw []byte) (string, error) {
+	sum := sha256.Sum256(raw)
+	checksum := hex.EncodeToString(sum[:])
+	if key, ok := messengerBlobShared(checksum); ok {
+		return key, nil
+	}
+
+	key, _, err := MessengerBlobPut(prefix, bytes.NewReader(raw), int64(len(raw)), checksum)
+	return key, err
+}
+
+// Take one more reference to the stored content
+func MessengerBlobRetain(key string) bool {
+	result := database.Postgres.Model(&model.MessengerBlob{}).
+		Where("key = ?", key).
+		Update("ref_count", gorm.Expr("ref_count + 1"))
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// Drop one reference to the stored content, unreferenced content is removed by
+// MessengerBlobCleanup; content stored before deduplication is removed at once
+func MessengerBlobRelease(key string) {
+	if key == "" {
+		return
+	}
+
+	result := database.Postgres.Model(&model.MessengerBlob{}).
+		Where("key = ? AND ref_count > 0", key).
+		Update("ref_count", gorm.Expr("ref_count - 1"))
+	if result.Error != nil || result.RowsAffected == 1 {
+		return
+	}
+
+	var count int64
+	database.Postgres.Model(&model.MessengerBlob{}).Where("key = ?", key).Count(&count)
+	if count == 0 {
+		database.Blob.Delete(key)
+	}
+}
+
+// Remove unreferenced content periodically, every node may run it
+func MessengerBlobCleanup() {
+	for range time.Tick(MessengerBlobCleanupInterval) {
+		blobs := []model.MessengerBlob{}
+		database.Postgres.Where("ref_count <= 0").Find(&blobs)
+		for _, blob := range blobs {
+			// The content may be referenced again since it was found
+			result := database.Postgres.Unscoped().
+				Where("id = ? AND ref_count <= 0", blob.ID).
+				Delete(&model.MessengerBlob{})
+			if result.Error == nil && result.RowsAffected == 1 {
+				database.Blob.Delete(blob.Key)
+			}
+		}
+	}
+}
+
+// Send the stored content of the size, a single byte range may be requested;
+// malformed and multiple ranges are answered with the whole content
+func messengerBlobSend(c *fiber.Ctx, key string, size int64) error {
+	c.Set("Accept-Ranges", "bytes")
+
+	partial := false
+	start, length := int64(0), size
+	if c.Get(fiber.HeaderRange) != "" {
+		ranges, err := c.Range(int(size))
+		if errors.Is(err, fiber.ErrRangeUnsatisfiable) {
+			c.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Range not satisfiable",
+				"data":    nil,
+			})
+		}
+		if err == nil && ranges.Type == "bytes" && len(ranges.Ranges) == 1 {
+			partial = true
+			start, length = int64(ranges.Ranges[0].Start), int64(ranges.Ranges[0].End-ranges.Ranges[0].Start+1)
+		}
+	}
+
+	var content io.ReadCloser
+	var err error
+	if partial {
+		content, err = database.Blob.GetRange(key, start, length)
+	} else {
+		content, err = database.Blob.Get(key)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "File not found",
+			"data":    nil,
+		})
+	}
+
+	if partial {
+		c.Status(fiber.StatusPartialContent)
+		c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	}
+	return c.SendStream(content, int(length))
+}
+
+// Key of the content with the checksum with a reference taken to it
+func messengerBlobShared(checksum string) (string, bool) {
+	blob := model.MessengerBlob{}
+	if err := database.Postgres.Where("checksum = ?", checksum).First(&blob).Error; err != nil {
+		return "", false
+	}
+	return blob.Key, MessengerBlobRetain(blob.Key)
+}
+
+// Record the content just stored under the key, if the same content is recorded already
+// its key is returned instead and the caller drops the copy
+func messengerBlobRegister(checksum string, key string, size int64) (string, error) {
+	var err error
+	// Concurrent puts of the same content race for the unique checksum, the losers share
+	// the content of the winner; the row may also vanish in between by the cleanup
+	for range 3 {
+		if shared, ok := messengerBlobShared(checksum); ok {
+			return shared, nil
+		}
+
+		err = database.Postgres.Create(&model.MessengerBlob{
+			Checksum: checksum,
+			Key:      key,
+			Size:     size,
+			RefCount: 1,
+		}).Error
+		if err == nil {
+			return key, nil
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+
+	"messenger-service/database"
+	"messenger-service/model"
+	"messenger-service/utils"
+)
+
+// Max number of pixels of uploaded image
+const MessengerImagePixelsMax = 50e6
+
+// Bounding square of image variants, in pixels
+const (
+	MessengerImageThumbnailSize = 320
+	MessengerImagePreviewSize   = 1280
+)
+
+// Image variants requested with ?size=
+const (
+	MessengerImageOriginal  = "original"
+	MessengerImagePreview   = "preview"
+	MessengerImageThumbnail = "thumbnail"
+)
+
+// Validate the image, drop its metadata and store it with scaled down variants,
+// the same image stored again shares the content of the first one
+func MessengerImageStore(raw []byte) (model.MessengerImage, error) {
+	sum := sha256.Sum256(raw)
+	checksum := hex.EncodeToString(sum[:])
+	if image, ok := messengerImageShared(checksum); ok {
+		return image, nil
+	}
+
+	src, format, err := utils.ImageDecode(raw, MessengerImagePixelsMax)
+	if err != nil {
+		return model.MessengerImage{}, err
+	}
+
+	// GIF has no EXIF and keeps its animation, others are encoded again without metadata,
+	// WebP can only be decoded and is stored as JPEG or PNG
+	original, mimeType := raw, "image/gif"
+	if format != "gif" {
+		encoding := format
+		if format == "webp" {
+			encoding = ""
+		}
+		original, mimeType, err = utils.ImageEncode(src, encoding)
+		if err != nil {
+			return model.MessengerImage{}, err
+		}
+	}
+
+	bounds := src.Bounds()
+	image := model.MessengerImage{
+		Uid:      utils.RandomId(),
+		Checksum: checksum,
+		MimeType: mimeType,
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+	}
+
+	image.Key, err = messengerImagePut(original)
+	if err == nil {
+		image.PreviewKey, err = messengerImageVariant(src, MessengerImagePreviewSize)
+	}
+	if err == nil {
+		image.ThumbnailKey, err = messengerImageVariant(src, MessengerImageThumbnailSize)
+	}
+	if err == nil {
+		err = database.Postgres.Create(&image).Error
+	}
+	if err != nil {
+		messengerImageBlobsRelease(image)
+		return model.MessengerImage{}, err
+	}
+
+	return image, nil
+}
+
+// Remove image with its content and variants
+func MessengerImageDelete(uid string) {
+	image := new(model.MessengerImage)
+	if err := database.Postgres.Where("uid = ?", uid).First(&image).Error; err != nil {
+		return
+	}
+	database.Postgres.Unscoped().Delete(&image)
+	messengerImageBlobsRelease(*image)
+}
+
+// Blob key of the image variant, images smaller than the variant and
+// images stored before variants were introduced fall back to the original
+func MessengerImageKey(image model.MessengerImage, size string) (string, bool) {
+	switch size {
+	case "", MessengerImageOriginal:
+		return image.Key, true
+	case MessengerImagePreview:
+		if image.PreviewKey != "" {
+			return image.PreviewKey, true
+		}
+		return image.Key, true
+	case MessengerImageThumbnail:
+		if image.ThumbnailKey != "" {
+			return image.ThumbnailKey, true
+		}
+		if image.PreviewKey != "" {
+			return image.PreviewKey, true
+		}
+		return image.Key, true
+	}
+	return "", false
+}
+
+// Message metadata describing the image
+func MessengerImageMetadata(image model.MessengerImage) string {
+	metadata, _ := json.Marshal(struct {
+		Width    int    `json:"width"`
+		Height   int    `json:"height"`
+		MimeType string `json:"mime_type"`
+	}{image.Width, image.Height, image.MimeType})
+	return string(metadata)
+}
+
+// Store the image scaled down to the size, nothing is stored for smaller images
+func messengerImageVariant(src image.Image, size int) (string, error) {
+	bounds := src.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return "", nil
+	}
+
+	variant, _, err := utils.ImageEncode(utils.ImageFit(src, size), "")
+	if err != nil {
+		return "", err
+	}
+	return messengerImagePut(variant)
+}
+
+// New image with the content of the image stored before from the same checksum
+func messengerImageShared(checksum string) (model.MessengerImage, bool) {
+	shared := model.MessengerImage{}
+	if err := database.Postgres.Where("checksum = ?", checksum).Last(&shared).Error; err != nil {
+		return model.MessengerImage{}, false
+	}
+
+	image := model.MessengerImage{
+		Uid:          utils.RandomId(),
+		Checksum:     checksum,
+		Key:          shared.Key,
+		ThumbnailKey: shared.ThumbnailKey,
+		PreviewKey:   shared.PreviewKey,
+		MimeType:     shared.MimeType,
+		Width:        shared.Width,
+		Height:       shared.Height,
+	}
+
+	// The shared image may be removed meanwhile, then the image is stored anew
+	retained := []string{}
+	for _, key := range messengerImageBlobs(image) {
+		if !MessengerBlobRetain(key) {
+			for _, key := range retained {
+				MessengerBlobRelease(key)
+			}
+			return model.MessengerImage{}, false
+		}
+		retained = append(retained, key)
+	}
+
+	if err := database.Postgres.Create(&image).Error; err != nil {
+		messengerImageBlobsRelease(image)
+		return model.MessengerImage{}, false
+	}
+
+	return image, true
+}
+
+func messengerImagePut(raw []byte) (string, error) {
+	return MessengerBlobPutBytes("image", raw)
+}
+
+// Keys of the stored image content and its variants
+func messengerImageBlobs(image model.MessengerImage) []string {
+	keys := []string{}
+	for _, key := range []string{image.Key, image.PreviewKey, image.ThumbnailKey} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func messengerImageBlobsRelease(image model.MessengerImage) {
+	for _, key := range messengerImageBlobs(image) {
+		MessengerBlobRelease(key)
+	}
+}
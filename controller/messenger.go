@@ -1,17 +1,1119 @@
 package controller
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"messenger-service/config"
 	"messenger-service/database"
 	"messenger-service/model"
+	"messenger-service/socketio"
+	"messenger-service/utils"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Message history page size
+const (
+	MessengerHistoryLimit    = 50
+	MessengerHistoryLimitMax = 100
 )
 
+// Length of quoted text in reply preview
+const MessengerReplyPreviewLength = 100
+
+// Max length of reaction emoji in bytes
+const MessengerReactionLength = 32
+
+// Max number of messages forwarded at once
+const MessengerForwardLimit = 100
+
+// Lifetime of cached unread totals
+const MessengerUnreadExpire = 24 * time.Hour
+
+// Messenger
+type MessengerMessage struct {
+	Id        uint                   `json:"id"`
+	Created   time.Time              `json:"created"`
+	EditedAt  *time.Time             `json:"edited_at"`
+	Dialog    uint                   `json:"dialog"`
+	From      MessengerUser          `json:"from"`
+	To        MessengerUser          `json:"to"`
+	Type      string                 `json:"type"`
+	Metadata  string                 `json:"metadata"`
+	Data      string                 `json:"data"`
+	Url       string                 `json:"url,omitempty"`
+	Read      bool                   `json:"read"`
+	Delivered *time.Time             `json:"delivered_at"`
+	Seen      *time.Time             `json:"read_at"`
+	Reply     *MessengerMessageReply `json:"reply"`
+	Forward   *MessengerUser         `json:"forwarded_from"`
+	Reactions []MessengerReaction    `json:"reactions"`
+}
+
+// Reactions of the message grouped by emoji
+type MessengerReaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me"`
+}
+
+// Messages of the author that got delivered to or read by the user
+type MessengerMessagesReceipt struct {
+	Dialog   uint      `json:"dialog"`
+	User     int       `json:"user"`
+	Ids      []uint    `json:"ids"`
+	Everyone []uint    `json:"everyone"`
+	Time     time.Time `json:"time"`
+}
+
+// Unread counter of the dialog and total of the user
+type MessengerUnread struct {
+	Dialog uint `json:"dialog"`
+	Count  int  `json:"count"`
+	Total  int  `json:"total"`
+}
+
+type MessengerReactionUpdate struct {
+	Id        uint                `json:"id"`
+	Dialog    uint                `json:"dialog"`
+	Reactions []MessengerReaction `json:"reactions"`
+}
+
+// Typing indicator of the user in the dialog
+type MessengerTyping struct {
+	Dialog uint `json:"dialog"`
+	User   int  `json:"user"`
+}
+
+// Compact preview of a quoted message
+type MessengerMessageReply struct {
+	Id      uint          `json:"id"`
+	From    MessengerUser `json:"from"`
+	Type    string        `json:"type"`
+	Data    string        `json:"data"`
+	Url     string        `json:"url,omitempty"`
+	Deleted bool          `json:"deleted"`
+}
+
+type MessengerDialog struct {
+	Id      uint                    `json:"id"`
+	Type    string                  `json:"type"`
+	Title   string                  `json:"title"`
+	Owner   MessengerUser           `json:"owner"`
+	User    MessengerUser           `json:"user"`
+	Members []MessengerDialogMember `json:"members"`
+	Message MessengerMessage        `json:"message"`
+	Unread  int                     `json:"unread"`
+}
+
+type MessengerDialogMember struct {
+	User MessengerUser `json:"user"`
+	Role string        `json:"role"`
+}
+
+type MessengerUser struct {
+	Id          uint   `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Avatar      string `json:"avatar"`
+	Contact     bool   `json:"contact"`
+	Alias       string `json:"alias"`
+}
+
+type MessengerDialogDetails struct {
+	Details  MessengerDialog    `json:"details"`
+	Messages []MessengerMessage `json:"messages"`
+	HasMore  bool               `json:"has_more"`
+}
+
+type MessengerMessageDelete struct {
+	Id       uint            `json:"id"`
+	Everyone bool            `json:"everyone"`
+	Dialog   MessengerDialog `json:"dialog"`
+}
+
+// Message history cursor, messages are paginated by id
+type MessengerHistoryCursor struct {
+	Before int
+	After  int
+	Limit  int
+}
+
+// Image behind a signed url, see MessengerImageUrl
 func MessengerMessageImage(c *fiber.Ctx) error {
 	image := new(model.MessengerImage)
-	database.Postgres.First(&image, c.AllParams()["id"])
-	data, _ := base64.StdEncoding.DecodeString(image.Data)
-	c.Set("Content-Type", "image/png")
-	return c.Send([]byte(data))
+	if err := database.Postgres.Where("uid = ?", c.Params("uid")).First(&image).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Image not found",
+			"data":    nil,
+		})
+	}
+
+	key, ok := MessengerImageKey(*image, c.Query("size"))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	content, err := database.Blob.Get(key)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Image not found",
+			"data":    nil,
+		})
+	}
+
+	// Variants are JPEG or PNG depending on transparency, the type is taken from the content
+	reader := bufio.NewReader(content)
+	head, _ := reader.Peek(512)
+	c.Set("Content-Type", http.DetectContentType(head))
+	return c.SendStream(struct {
+		io.Reader
+		io.Closer
+	}{reader, content})
+}
+
+func MessengerDialogMessages(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	owner, _ := strconv.Atoi(claims["id"].(string))
+
+	dialogId, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	dialog, err := MessengerDialogFind(uint(dialogId))
+	if err == nil {
+		_, ok := MessengerDialogMemberFind(dialog, owner)
+		if !ok {
+			err = gorm.ErrRecordNotFound
+		}
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Dialog not found",
+			"data":    nil,
+		})
+	}
+
+	rawMessages, hasMore := MessengerHistory(dialog.ID, owner, MessengerHistoryCursor{
+		Before: c.QueryInt("before"),
+		After:  c.QueryInt("after"),
+		Limit:  c.QueryInt("limit"),
+	})
+
+	messages := []MessengerMessage{}
+	for _, message := range rawMessages {
+		messages = append(messages, NewMessengerMessage(message, owner))
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data": fiber.Map{
+			"messages": messages,
+			"has_more": hasMore,
+		},
+	})
+}
+
+// Page of dialog messages visible to the viewer ordered by id,
+// without cursor the latest messages are returned
+func MessengerHistory(dialog uint, viewer int, cursor MessengerHistoryCursor) ([]model.MessengerMessage, bool) {
+	limit := cursor.Limit
+	if limit <= 0 {
+		limit = MessengerHistoryLimit
+	}
+	if limit > MessengerHistoryLimitMax {
+		limit = MessengerHistoryLimitMax
+	}
+
+	query := database.Postgres.
+		Where(&model.MessengerMessage{DialogID: dialog}).
+		Where("id NOT IN (?)", MessengerHidden(viewer)).
+		Preload("From").
+		Preload("To").
+		Preload("Receipts").
+		Preload("Reply").
+		Preload("Reply.From").
+		Preload("Reply.Receipts", "user_id = ?", viewer).
+		Preload("ForwardFrom").
+		Preload("Reactions", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id asc")
+		}).
+		Limit(limit + 1)
+
+	if cursor.After > 0 {
+		query = query.Where("id > ?", cursor.After).Order("id asc")
+	} else {
+		if cursor.Before > 0 {
+			query = query.Where("id < ?", cursor.Before)
+		}
+		query = query.Order("id desc")
+	}
+
+	messages := []model.MessengerMessage{}
+	query.Find(&messages)
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	if cursor.After <= 0 {
+		slices.Reverse(messages)
+	}
+
+	return messages, hasMore
+}
+
+func MessengerDialogPreload(db *gorm.DB) *gorm.DB {
+	return db.
+		Preload("Owner").
+		Preload("Message").
+		Preload("Message.From").
+		Preload("Message.To").
+		Preload("Message.Receipts").
+		Preload("Message.Reply").
+		Preload("Message.Reply.From").
+		Preload("Message.Reply.Receipts").
+		Preload("Message.ForwardFrom").
+		Preload("Members", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id asc")
+		}).
+		Preload("Members.User")
+}
+
+func MessengerDialogFind(id uint) (model.MessengerDialog, error) {
+	dialog := model.MessengerDialog{}
+	err := database.Postgres.Scopes(MessengerDialogPreload).First(&dialog, id).Error
+	return dialog, err
+}
+
+func MessengerMessagePreload(db *gorm.DB) *gorm.DB {
+	return db.
+		Preload("From").
+		Preload("To").
+		Preload("Receipts").
+		Preload("Reply").
+		Preload("Reply.From").
+		Preload("Reply.Receipts").
+		Preload("ForwardFrom").
+		Preload("Reactions", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id asc")
+		})
+}
+
+func MessengerMessageFind(id uint) (model.MessengerMessage, error) {
+	message := model.MessengerMessage{}
+	err := database.Postgres.Scopes(MessengerMessagePreload).First(&message, id).Error
+	return message, err
+}
+
+// Direct dialog between two users
+func MessengerDialogDirect(from int, to int) (model.MessengerDialog, error) {
+	dialog := model.MessengerDialog{}
+	err := database.Postgres.
+		Scopes(MessengerDialogPreload).
+		Where(
+			"type = ? AND ((owner_id = ? AND user_id = ?) OR (owner_id = ? AND user_id = ?))",
+			model.MessengerDialogDirect,
+			from,
+			to,
+			to,
+			from,
+		).
+		First(&dialog).Error
+	return dialog, err
+}
+
+// Direct dialog between two users, created when users did not talk before
+func MessengerDialogDirectFindOrCreate(from int, to int) (model.MessengerDialog, bool, error) {
+	if dialog, err := MessengerDialogDirect(from, to); err == nil {
+		return dialog, false, nil
+	}
+
+	rawDialog := new(model.MessengerDialog)
+	rawDialog.Type = model.MessengerDialogDirect
+	rawDialog.OwnerID = from
+	rawDialog.UserID = &to
+	rawDialog.Members = []model.MessengerDialogMember{
+		{
+			UserID: from,
+			Role:   model.MessengerRoleMember,
+		},
+		{
+			UserID: to,
+			Role:   model.MessengerRoleMember,
+		},
+	}
+	if err := database.Postgres.Create(&rawDialog).Error; err != nil {
+		return model.MessengerDialog{}, false, err
+	}
+
+	dialog, err := MessengerDialogFind(rawDialog.ID)
+	return dialog, true, err
+}
+
+// Whether the user accepts messages from the sender according to blocks and privacy settings
+func MessengerAllowed(from int, to int) bool {
+	if slices.Contains(UserBlockIds(to), from) {
+		return false
+	}
+
+	switch UserSettingsFind(to).WhoCanMessage {
+	case model.UserMessageNobody:
+		return false
+	case model.UserMessageContacts:
+		_, ok := UserContactsFind(to)[from]
+		return ok
+	}
+	return true
+}
+
+// Whether the member can write to the dialog, direct dialogs respect settings of the peer
+func MessengerDialogAllowed(dialog model.MessengerDialog, from int) bool {
+	if dialog.Type != model.MessengerDialogDirect {
+		return true
+	}
+
+	for _, member := range dialog.Members {
+		if member.UserID != from {
+			return MessengerAllowed(from, member.UserID)
+		}
+	}
+	return true
+}
+
+// Dialogs the user is a member of
+func MessengerDialogList(owner int) []model.MessengerDialog {
+	dialogs := []model.MessengerDialog{}
+	database.Postgres.
+		Scopes(MessengerDialogPreload).
+		Where(
+			"id IN (?)",
+			database.Postgres.Model(&model.MessengerDialogMember{}).Select("dialog_id").Where(&model.MessengerDialogMember{UserID: owner}),
+		).
+		Find(&dialogs)
+
+	// Last message hidden by the owner is replaced by the last visible one
+	for i := range dialogs {
+		for _, receipt := range dialogs[i].Message.Receipts {
+			if receipt.UserID == owner && receipt.Hidden {
+				dialogs[i].Message = MessengerDialogLast(dialogs[i].ID, owner)
+				break
+			}
+		}
+	}
+
+	return dialogs
+}
+
+// Last message of the dialog visible to the viewer
+func MessengerDialogLast(dialog uint, viewer int) model.MessengerMessage {
+	messages, _ := MessengerHistory(dialog, viewer, MessengerHistoryCursor{Limit: 1})
+	if len(messages) == 0 {
+		return model.MessengerMessage{}
+	}
+	return messages[0]
+}
+
+// Point dialog to its last message which was not deleted
+func MessengerDialogRefresh(dialog uint) {
+	var id *uint
+	last := model.MessengerMessage{}
+	if err := database.Postgres.Where(&model.MessengerMessage{DialogID: dialog}).Where("type <> ?", "deleted").Order("id desc").First(&last).Error; err == nil {
+		id = &last.ID
+	}
+
+	database.Postgres.Model(&model.MessengerDialog{}).Where("id = ?", dialog).Update("message_id", id)
+}
+
+func MessengerDialogMemberFind(dialog model.MessengerDialog, user int) (model.MessengerDialogMember, bool) {
+	for _, member := range dialog.Members {
+		if member.UserID == user {
+			return member, true
+		}
+	}
+	return model.MessengerDialogMember{}, false
+}
+
+// Mark messages of the dialog up to the message, or all if it is 0, as read by the user
+// and push the receipts to authors of the messages
+func MessengerDialogRead(dialog uint, user int, until uint) {
+	messengerDialogReceipts(dialog, user, until, true)
+}
+
+// Mark messages of the dialog up to the message, or all if it is 0, as delivered to the user
+// and push the receipts to authors of the messages
+func MessengerDialogDelivered(dialog uint, user int, until uint) {
+	messengerDialogReceipts(dialog, user, until, false)
+}
+
+func messengerDialogReceipts(dialog uint, user int, until uint, read bool) {
+	column, event := "delivered_at", "messages_delivered"
+	pending := column + " IS NULL"
+	if read {
+		column, event = "read_at", "messages_read"
+		pending = "(read_at IS NULL OR silent = true)"
+	}
+
+	// Users with disabled read receipts read messages without telling authors
+	silent := read && UserSettingsFind(user).DisableReadReceipts
+
+	// Messages of other members still waiting for the receipt
+	query := database.Postgres.
+		Select("id", "from_id").
+		Where(&model.MessengerMessage{DialogID: dialog}).
+		Where("from_id <> ?", user).
+		Where(
+			"id IN (?)",
+			database.Postgres.Model(&model.MessengerReceipt{}).Select("message_id").Where("user_id = ? AND "+column+" IS NULL", user),
+		).
+		Order("id asc")
+	if until > 0 {
+		query = query.Where("id <= ?", until)
+	}
+
+	messages := []model.MessengerMessage{}
+	query.Find(&messages)
+	if len(messages) == 0 {
+		return
+	}
+
+	ids := []uint{}
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"delivered_at": now,
+	}
+	if read {
+		updates["delivered_at"] = gorm.Expr("COALESCE(delivered_at, ?)", now)
+		updates["read_at"] = now
+		updates["silent"] = silent
+	}
+	database.Postgres.
+		Model(&model.MessengerReceipt{}).
+		Where("user_id = ? AND message_id IN ?", user, ids).
+		Where(column + " IS NULL").
+		Updates(updates)
+
+	if silent {
+		MessengerUnreadCount(dialog, user)
+		return
+	}
+
+	// Messages that now have the receipt from every member
+	everyone := []uint{}
+	database.Postgres.
+		Model(&model.MessengerMessage{}).
+		Where("id IN ?", ids).
+		Where(
+			"id NOT IN (?)",
+			database.Postgres.Model(&model.MessengerReceipt{}).Select("message_id").Where("message_id IN ? AND "+pending, ids),
+		).
+		Pluck("id", &everyone)
+
+	receipts := map[int]*MessengerMessagesReceipt{}
+	authors := []int{}
+	for _, message := range messages {
+		receipt, ok := receipts[message.FromID]
+		if !ok {
+			receipt = &MessengerMessagesReceipt{
+				Dialog:   dialog,
+				User:     user,
+				Ids:      []uint{},
+				Everyone: []uint{},
+				Time:     now,
+			}
+			receipts[message.FromID] = receipt
+			authors = append(authors, message.FromID)
+		}
+
+		receipt.Ids = append(receipt.Ids, message.ID)
+		if slices.Contains(everyone, message.ID) {
+			receipt.Everyone = append(receipt.Everyone, message.ID)
+		}
+	}
+
+	for _, author := range authors {
+		socketio.Emit(strconv.Itoa(author), event, receipts[author])
+	}
+
+	if read {
+		MessengerUnreadCount(dialog, user)
+	}
+}
+
+// Messages hidden by the user
+func MessengerHidden(user int) *gorm.DB {
+	return database.Postgres.Model(&model.MessengerReceipt{}).Select("message_id").Where(&model.MessengerReceipt{UserID: user, Hidden: true})
+}
+
+// Store a single message with a receipt for every member of the dialog,
+// message holds the content: type, stored data and reply
+func MessengerSend(dialog model.MessengerDialog, from int, message model.MessengerMessage) model.MessengerMessage {
+	// Get [from] user
+	fromUser := new(model.User)
+	database.Postgres.First(&fromUser, from)
+
+	now := time.Now()
+	message.DialogID = dialog.ID
+	message.From = *fromUser
+	for _, member := range dialog.Members {
+		receipt := model.MessengerReceipt{
+			UserID: member.UserID,
+		}
+
+		if member.UserID == from {
+			receipt.DeliveredAt = &now
+			receipt.ReadAt = &now
+		} else if dialog.Type == model.MessengerDialogDirect {
+			message.To = member.User
+		}
+
+		message.Receipts = append(message.Receipts, receipt)
+	}
+	database.Postgres.Omit("Reply").Create(&message)
+
+	// Update dialog
+	database.Postgres.Model(&model.MessengerDialog{}).Where("id = ?", dialog.ID).Update("message_id", message.ID)
+
+	// Update unread counters of other members
+	members := []model.MessengerDialogMember{}
+	database.Postgres.
+		Model(&members).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "user_id"}, {Name: "unread"}}}).
+		Where("dialog_id = ? AND user_id <> ?", dialog.ID, from).
+		Update("unread", gorm.Expr("unread + 1"))
+	messengerUnreadIncrement(dialog.ID, members)
+
+	return message
+}
+
+// Cached totals are incremented where they exist, -1 is returned for totals not cached
+var messengerUnreadIncrementScript = redis.NewScript(`
+local totals = {}
+for i, key in ipairs(KEYS) do
+	if redis.call("EXISTS", key) == 1 then
+		totals[i] = redis.call("INCR", key)
+	else
+		totals[i] = -1
+	end
+end
+return totals
+`)
+
+// Push counters of members whose dialog counter was just incremented, cached totals are
+// incremented at once and missing ones are summed in one query
+func messengerUnreadIncrement(dialog uint, members []model.MessengerDialogMember) {
+	if len(members) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	keys := []string{}
+	for _, member := range members {
+		keys = append(keys, messengerUnreadKey(member.UserID))
+	}
+	cached, _ := messengerUnreadIncrementScript.Run(ctx, database.Redis[0], keys).Int64Slice()
+
+	totals := map[int]int{}
+	missing := []int{}
+	for i, member := range members {
+		if i < len(cached) && cached[i] >= 0 {
+			totals[member.UserID] = int(cached[i])
+		} else {
+			missing = append(missing, member.UserID)
+		}
+	}
+
+	if len(missing) > 0 {
+		rows := []struct {
+			UserID int
+			Total  int
+		}{}
+		database.Postgres.
+			Model(&model.MessengerDialogMember{}).
+			Select("user_id, COALESCE(SUM(unread), 0) AS total").
+			Where("user_id IN ?", missing).
+			Group("user_id").
+			Scan(&rows)
+
+		database.Redis[0].Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, row := range rows {
+				totals[row.UserID] = row.Total
+				pipe.Set(ctx, messengerUnreadKey(row.UserID), row.Total, MessengerUnreadExpire)
+			}
+			return nil
+		})
+	}
+
+	for _, member := range members {
+		socketio.Emit(strconv.Itoa(member.UserID), "unread_total", MessengerUnread{
+			Dialog: dialog,
+			Count:  member.Unread,
+			Total:  totals[member.UserID],
+		})
+	}
+}
+
+// Recount unread messages of the dialog for the user and push the counters
+func MessengerUnreadCount(dialog uint, user int) {
+	var count int64
+	database.Postgres.
+		Model(&model.MessengerReceipt{}).
+		Where("user_id = ? AND read_at IS NULL AND hidden = ?", user, false).
+		Where(
+			"message_id IN (?)",
+			database.Postgres.Model(&model.MessengerMessage{}).Select("id").Where("dialog_id = ? AND from_id <> ? AND type <> ?", dialog, user, "deleted"),
+		).
+		Count(&count)
+
+	database.Postgres.
+		Model(&model.MessengerDialogMember{}).
+		Where(&model.MessengerDialogMember{DialogID: dialog, UserID: user}).
+		Update("unread", count)
+
+	MessengerUnreadPush(dialog, user)
+}
+
+// Drop the cached total of the user and push counters of the dialog
+func MessengerUnreadPush(dialog uint, user int) {
+	database.Redis[0].Del(context.Background(), messengerUnreadKey(user))
+
+	member := model.MessengerDialogMember{}
+	database.Postgres.Where(&model.MessengerDialogMember{DialogID: dialog, UserID: user}).Limit(1).Find(&member)
+
+	socketio.Emit(strconv.Itoa(user), "unread_total", MessengerUnread{
+		Dialog: dialog,
+		Count:  member.Unread,
+		Total:  MessengerUnreadTotal(user),
+	})
+}
+
+// Unread messages in all dialogs of the user, cached in Redis
+func MessengerUnreadTotal(user int) int {
+	ctx := context.Background()
+	if total, err := database.Redis[0].Get(ctx, messengerUnreadKey(user)).Int(); err == nil {
+		return total
+	}
+
+	var total int
+	database.Postgres.
+		Model(&model.MessengerDialogMember{}).
+		Select("COALESCE(SUM(unread), 0)").
+		Where(&model.MessengerDialogMember{UserID: user}).
+		Scan(&total)
+
+	database.Redis[0].Set(ctx, messengerUnreadKey(user), total, MessengerUnreadExpire)
+
+	return total
+}
+
+func messengerUnreadKey(user int) string {
+	return "messenger:unread:" + strconv.Itoa(user)
+}
+
+// Socket room of the dialog, joined by connections of every member
+func MessengerDialogRoom(dialog uint) string {
+	return "dialog:" + strconv.FormatUint(uint64(dialog), 10)
+}
+
+// Subscribe connections of every member to the dialog room
+func MessengerDialogJoin(dialog model.MessengerDialog) {
+	for _, member := range dialog.Members {
+		socketio.Join(strconv.Itoa(member.UserID), MessengerDialogRoom(dialog.ID))
+	}
+}
+
+// Emit dialog to every member, as seen by the member
+func MessengerEmitDialog(dialog model.MessengerDialog, event string, except ...int) {
+	users := []int{}
+	for _, member := range dialog.Members {
+		if !slices.Contains(except, member.UserID) {
+			users = append(users, member.UserID)
+		}
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	contacts := UserContactsFindMany(users)
+	for _, user := range users {
+		socketio.Emit(strconv.Itoa(user), event, NewMessengerDialog(dialog, user, contacts[user]))
+	}
+}
+
+// Emit message to every member, as seen by the member
+func MessengerEmitMessage(dialog model.MessengerDialog, message model.MessengerMessage, event string) {
+	for _, member := range dialog.Members {
+		socketio.Emit(strconv.Itoa(member.UserID), event, NewMessengerMessage(message, member.UserID))
+	}
+}
+
+// Store attachment and return message data with metadata,
+// files and voice audio are uploaded beforehand and referenced by uid
+func MessengerMessageData(_type string, data string, from int) (string, string, bool) {
+	switch _type {
+	case "text":
+		return data, "", true
+	case "image":
+		raw, ok := messengerImageData(data, from)
+		if !ok {
+			return "", "", false
+		}
+		image, err := MessengerImageStore(raw)
+		if err != nil {
+			return "", "", false
+		}
+		return image.Uid, MessengerImageMetadata(image), true
+	case "file":
+		attachment := new(model.MessengerAttachment)
+		if err := database.Postgres.Where("uid = ? AND user_id = ?", data, from).First(&attachment).Error; err != nil {
+			return "", "", false
+		}
+		return attachment.Uid, MessengerAttachmentMetadata(*attachment), true
+	case "voice":
+		attachment := new(model.MessengerAttachment)
+		if err := database.Postgres.Where("uid = ? AND user_id = ?", data, from).First(&attachment).Error; err != nil {
+			return "", "", false
+		}
+		metadata, ok := MessengerVoiceMetadata(*attachment)
+		if !ok {
+			return "", "", false
+		}
+		return attachment.Uid, metadata, true
+	}
+	return "", "", false
+}
+
+// Image content sent inline as base64 or uploaded beforehand as file, the uploaded file
+// is released once the image is read
+func messengerImageData(data string, from int) ([]byte, bool) {
+	attachment := new(model.MessengerAttachment)
+	if err := database.Postgres.Where("uid = ? AND user_id = ?", data, from).First(&attachment).Error; err != nil {
+		raw, err := base64.StdEncoding.DecodeString(data)
+		return raw, err == nil
+	}
+
+	content, err := database.Blob.Get(attachment.Key)
+	if err != nil {
+		return nil, false
+	}
+	defer content.Close()
+
+	raw, err := io.ReadAll(content)
+	if err != nil {
+		return nil, false
+	}
+
+	MessengerAttachmentRelease(attachment.Uid)
+	return raw, true
+}
+
+// Remove image which is not referenced by messages anymore
+func MessengerImageRelease(uid string) {
+	var count int64
+	database.Postgres.Model(&model.MessengerMessage{}).Where(&model.MessengerMessage{Type: "image", Data: uid}).Count(&count)
+	if count == 0 {
+		MessengerImageDelete(uid)
+	}
+}
+
+func NewMessengerUser(user model.User) MessengerUser {
+	avatar := ""
+	if user.Avatar != "" {
+		avatar = MessengerImageUrl(user.Avatar)
+	}
+
+	return MessengerUser{
+		Id:          user.ID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Avatar:      avatar,
+	}
+}
+
+// Signed url of the stored image, ?size= may be appended
+func MessengerImageUrl(uid string) string {
+	return MessengerMediaUrl("/v1/messenger/image/" + uid)
+}
+
+// Signed url of the uploaded file
+func MessengerAttachmentUrl(uid string) string {
+	return MessengerMediaUrl("/v1/messenger/attachment/" + uid)
+}
+
+// Signed url of the voice message audio
+func MessengerVoiceUrl(uid string) string {
+	return MessengerMediaUrl("/v1/messenger/voice/" + uid)
+}
+
+// Sign the media path, urls issued within one expiry window are the same
+// so clients can cache the media, each url lives from one to two windows
+func MessengerMediaUrl(path string) string {
+	window := messengerMediaUrlWindow()
+	expires := (time.Now().Unix()/window + 2) * window
+	return path + "?" + utils.SignUrl(path, expires)
+}
+
+// Expiry window of media urls in seconds, read once
+var messengerMediaUrlWindow = sync.OnceValue(func() int64 {
+	minutes, _ := strconv.ParseInt(config.Config("MEDIA_URL_EXPIRE"), 10, 64)
+	return max(minutes, 1) * 60
+})
+
+// Reaction consists of emoji only: pictographs and flags with the joiners, variation selectors,
+// skin tones and tags they are built from; digits, # and * only as keycaps
+func MessengerReactionValid(emoji string) bool {
+	if emoji == "" || len(emoji) > MessengerReactionLength || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	keycap := strings.ContainsRune(emoji, '\u20e3')
+	pictograph := false
+	for _, r := range emoji {
+		switch {
+		case unicode.Is(unicode.So, r):
+			pictograph = true
+		case r == '\u20e3' || r == '\u200d' || r == '\ufe0f' || r == '\ufe0e':
+		case r >= 0x1f3fb && r <= 0x1f3ff, r >= 0xe0020 && r <= 0xe007f:
+		case keycap && (r >= '0' && r <= '9' || r == '#' || r == '*'):
+			pictograph = true
+		default:
+			return false
+		}
+	}
+	return pictograph
+}
+
+// Url of the media referenced by the message data
+func MessengerMessageUrl(_type string, data string) string {
+	switch _type {
+	case "image":
+		return MessengerImageUrl(data)
+	case "file":
+		return MessengerAttachmentUrl(data)
+	case "voice":
+		return MessengerVoiceUrl(data)
+	}
+	return ""
+}
+
+// User with the alias given by the viewer if the user is a contact of the viewer
+func NewMessengerContact(user model.User, contacts map[int]model.UserContact) MessengerUser {
+	messengerUser := NewMessengerUser(user)
+	if contact, ok := contacts[int(user.ID)]; ok {
+		messengerUser.Contact = true
+		messengerUser.Alias = contact.Alias
+	}
+	return messengerUser
+}
+
+// Message as seen by the viewer, messages sent before the viewer
+// joined the dialog have no receipt and are considered read
+func NewMessengerMessage(message model.MessengerMessage, viewer int) MessengerMessage {
+	read := true
+	for _, receipt := range message.Receipts {
+		if receipt.UserID == viewer {
+			read = receipt.ReadAt != nil
+			break
+		}
+	}
+
+	// Author sees when the message reached every other member
+	var delivered, seen *time.Time
+	if message.FromID == viewer {
+		delivered = messengerReceiptsTime(message.Receipts, viewer, func(receipt model.MessengerReceipt) *time.Time {
+			return receipt.DeliveredAt
+		})
+		seen = messengerReceiptsTime(message.Receipts, viewer, func(receipt model.MessengerReceipt) *time.Time {
+			if receipt.Silent {
+				return nil
+			}
+			return receipt.ReadAt
+		})
+	}
+
+	var reply *MessengerMessageReply
+	if message.ReplyID != nil {
+		reply = NewMessengerMessageReply(message.Reply, *message.ReplyID, viewer)
+	}
+
+	var forward *MessengerUser
+	if message.ForwardFromID != nil {
+		user := NewMessengerUser(message.ForwardFrom)
+		forward = &user
+	}
+
+	return MessengerMessage{
+		Id:        message.ID,
+		Created:   message.CreatedAt,
+		EditedAt:  message.EditedAt,
+		Dialog:    message.DialogID,
+		From:      NewMessengerUser(message.From),
+		To:        NewMessengerUser(message.To),
+		Type:      message.Type,
+		Metadata:  message.Metadata,
+		Data:      message.Data,
+		Url:       MessengerMessageUrl(message.Type, message.Data),
+		Read:      read,
+		Delivered: delivered,
+		Seen:      seen,
+		Reply:     reply,
+		Forward:   forward,
+		Reactions: NewMessengerReactions(message.Reactions, viewer),
+	}
+}
+
+// Latest time of the receipts of all members except the author, nil while any is missing
+func messengerReceiptsTime(receipts []model.MessengerReceipt, author int, field func(model.MessengerReceipt) *time.Time) *time.Time {
+	var latest *time.Time
+	for _, receipt := range receipts {
+		if receipt.UserID == author {
+			continue
+		}
+
+		value := field(receipt)
+		if value == nil {
+			return nil
+		}
+
+		if latest == nil || value.After(*latest) {
+			latest = value
+		}
+	}
+	return latest
+}
+
+// Reactions grouped by emoji in order of the first reaction
+func NewMessengerReactions(reactions []model.MessengerReaction, viewer int) []MessengerReaction {
+	grouped := []MessengerReaction{}
+	for _, reaction := range reactions {
+		i := slices.IndexFunc(grouped, func(r MessengerReaction) bool {
+			return r.Emoji == reaction.Emoji
+		})
+		if i < 0 {
+			grouped = append(grouped, MessengerReaction{Emoji: reaction.Emoji})
+			i = len(grouped) - 1
+		}
+
+		grouped[i].Count++
+		if reaction.UserID == viewer {
+			grouped[i].Me = true
+		}
+	}
+	return grouped
+}
+
+// Quoted message as seen by the viewer, deleted and hidden messages
+// are quoted without content
+func NewMessengerMessageReply(message *model.MessengerMessage, id uint, viewer int) *MessengerMessageReply {
+	deleted := message == nil || message.Type == "deleted"
+	if !deleted {
+		for _, receipt := range message.Receipts {
+			if receipt.UserID == viewer && receipt.Hidden {
+				deleted = true
+				break
+			}
+		}
+	}
+
+	if deleted {
+		return &MessengerMessageReply{
+			Id:      id,
+			Deleted: true,
+		}
+	}
+
+	data := message.Data
+	if message.Type == "text" {
+		if runes := []rune(data); len(runes) > MessengerReplyPreviewLength {
+			data = string(runes[:MessengerReplyPreviewLength]) + "…"
+		}
+	}
+
+	// Quoted images are shown small
+	url := MessengerMessageUrl(message.Type, message.Data)
+	if message.Type == "image" {
+		url += "&size=" + MessengerImageThumbnail
+	}
+
+	return &MessengerMessageReply{
+		Id:   message.ID,
+		From: NewMessengerUser(message.From),
+		Type: message.Type,
+		Data: data,
+		Url:  url,
+	}
+}
+
+// Dialog as seen by the viewer with contacts of the viewer, in direct dialogs the viewer is the owner
+func NewMessengerDialog(dialog model.MessengerDialog, viewer int, contacts map[int]model.UserContact) MessengerDialog {
+	owner := dialog.Owner
+	user := model.User{}
+	members := []MessengerDialogMember{}
+	unread := 0
+	for _, member := range dialog.Members {
+		members = append(members, MessengerDialogMember{
+			User: NewMessengerContact(member.User, contacts),
+			Role: member.Role,
+		})
+
+		if member.UserID == viewer {
+			unread = member.Unread
+		}
+
+		if dialog.Type == model.MessengerDialogDirect {
+			if member.UserID == viewer {
+				owner = member.User
+			} else {
+				user = member.User
+			}
+		}
+	}
+
+	message := NewMessengerMessage(dialog.Message, viewer)
+	message.Dialog = dialog.ID
+
+	return MessengerDialog{
+		Id:      dialog.ID,
+		Type:    dialog.Type,
+		Title:   dialog.Title,
+		Owner:   NewMessengerContact(owner, contacts),
+		User:    NewMessengerContact(user, contacts),
+		Members: members,
+		Message: message,
+		Unread:  unread,
+	}
 }
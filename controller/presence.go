@@ -0,0 +1,233 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"messenger-service/database"
+	"messenger-service/model"
+	"messenger-service/socketio"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Connections refresh presence every interval and are counted as gone after the timeout,
+// so a crashed node does not keep its users online
+const (
+	MessengerPresenceInterval = 30 * time.Second
+	MessengerPresenceTimeout  = 90 * time.Second
+)
+
+type MessengerUserStatus struct {
+	Id       uint       `json:"id"`
+	Status   bool       `json:"status"`
+	LastSeen *time.Time `json:"last_seen"`
+}
+
+// Register or refresh the connection of the user, pushes presence if the user came online;
+// last seen is kept up to date so it is known when the node of the user crashes
+func MessengerPresenceHeartbeat(user int, connection string) {
+	ctx := context.Background()
+	key := messengerPresenceKey(user)
+	now := time.Now()
+	expires := float64(now.Add(MessengerPresenceTimeout).UnixMilli())
+
+	var added *redis.IntCmd
+	var count *redis.IntCmd
+	_, err := database.Redis[0].TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+		added = pipe.ZAdd(ctx, key, redis.Z{
+			Score:  expires,
+			Member: connection,
+		})
+		count = pipe.ZCard(ctx, key)
+		pipe.Expire(ctx, key, MessengerPresenceTimeout)
+		pipe.ZAddGT(ctx, messengerPresenceOnlineKey, redis.Z{
+			Score:  expires,
+			Member: user,
+		})
+		pipe.Set(ctx, messengerLastSeenKey(user), now.Unix(), 0)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// First connection of the user
+	if added.Val() == 1 && count.Val() == 1 {
+		messengerPresenceChanged(user, MessengerUserStatus{
+			Id:     uint(user),
+			Status: true,
+		})
+	}
+}
+
+// Unregister the connection of the user, stores last seen and pushes presence
+// if it was the last connection
+func MessengerPresenceLeave(user int, connection string) {
+	ctx := context.Background()
+	key := messengerPresenceKey(user)
+	now := time.Now()
+
+	var count *redis.IntCmd
+	_, err := database.Redis[0].TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, key, connection)
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+		count = pipe.ZCard(ctx, key)
+		return nil
+	})
+	if err != nil || count.Val() > 0 {
+		return
+	}
+
+	database.Redis[0].ZRem(ctx, messengerPresenceOnlineKey, user)
+	database.Redis[0].Set(ctx, messengerLastSeenKey(user), now.Unix(), 0)
+
+	messengerPresenceChanged(user, MessengerUserStatus{
+		Id:       uint(user),
+		Status:   false,
+		LastSeen: &now,
+	})
+}
+
+// Removes the user from online users if the last connection of the user has expired
+var messengerPresenceExpireScript = redis.NewScript(`
+local expires = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if expires and tonumber(expires) <= tonumber(ARGV[2]) then
+	return redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// Push offline users whose connections expired without disconnect when their node crashed,
+// every node may run it and only the one removing the user pushes
+func MessengerPresenceSweep() {
+	for range time.Tick(MessengerPresenceInterval) {
+		ctx := context.Background()
+		now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+		users, _ := database.Redis[0].ZRangeByScore(ctx, messengerPresenceOnlineKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: now,
+		}).Result()
+		for _, member := range users {
+			// The user may have come back since
+			removed, err := messengerPresenceExpireScript.Run(ctx, database.Redis[0], []string{messengerPresenceOnlineKey}, member, now).Int()
+			if err != nil || removed == 0 {
+				continue
+			}
+
+			user, _ := strconv.Atoi(member)
+			status := MessengerUserStatus{Id: uint(user)}
+			if seconds, err := database.Redis[0].Get(ctx, messengerLastSeenKey(user)).Int64(); err == nil {
+				seen := time.Unix(seconds, 0)
+				status.LastSeen = &seen
+			}
+			messengerPresenceChanged(user, status)
+		}
+	}
+}
+
+// Presence of the users across all nodes as the viewer sees it
+func MessengerPresence(viewer int, users []int) []MessengerUserStatus {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	counts := make([]*redis.IntCmd, len(users))
+	lastSeen := make([]*redis.StringCmd, len(users))
+	database.Redis[0].Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, user := range users {
+			counts[i] = pipe.ZCount(ctx, messengerPresenceKey(user), "("+now, "+inf")
+			lastSeen[i] = pipe.Get(ctx, messengerLastSeenKey(user))
+		}
+		return nil
+	})
+
+	settings := UserSettingsFindMany(users)
+	blocks := UserBlockIds(viewer)
+	statuses := []MessengerUserStatus{}
+	for i, user := range users {
+		status := MessengerUserStatus{
+			Id:     uint(user),
+			Status: counts[i].Val() > 0,
+		}
+
+		if seconds, err := lastSeen[i].Int64(); err == nil && !status.Status {
+			seen := time.Unix(seconds, 0)
+			status.LastSeen = &seen
+		}
+
+		// Blocked users see nothing
+		if slices.Contains(blocks, user) {
+			status = MessengerUserStatus{Id: uint(user)}
+		}
+
+		statuses = append(statuses, messengerPresencePrivacy(status, settings[user]))
+	}
+	return statuses
+}
+
+// Push presence of the user to everyone who has a dialog with the user
+func MessengerPresencePush(user int, status MessengerUserStatus) {
+	status = messengerPresencePrivacy(status, UserSettingsFind(user))
+	blocks := UserBlockIds(user)
+
+	for _, peer := range MessengerPeerIds(user) {
+		if slices.Contains(blocks, peer) {
+			continue
+		}
+
+		socketio.Emit(strconv.Itoa(peer), "presence_changed", status)
+	}
+}
+
+// Push the user coming online or going offline, users hiding online status
+// look offline all the time so there is nothing to push
+func messengerPresenceChanged(user int, status MessengerUserStatus) {
+	if UserSettingsFind(user).HideOnline {
+		return
+	}
+	MessengerPresencePush(user, status)
+}
+
+// Users who have a dialog with the user
+func MessengerPeerIds(user int) []int {
+	peers := []int{}
+	database.Postgres.
+		Model(&model.MessengerDialogMember{}).
+		Distinct("user_id").
+		Where(
+			"dialog_id IN (?) AND user_id <> ?",
+			database.Postgres.Model(&model.MessengerDialogMember{}).Select("dialog_id").Where(&model.MessengerDialogMember{UserID: user}),
+			user,
+		).
+		Order("user_id asc").
+		Pluck("user_id", &peers)
+	return peers
+}
+
+// Presence as seen by other users according to privacy settings, users hiding online status
+// are offline without last seen whether they are connected or not
+func messengerPresencePrivacy(status MessengerUserStatus, settings model.UserSettings) MessengerUserStatus {
+	if settings.HideOnline {
+		status.Status = false
+		status.LastSeen = nil
+	}
+	if settings.HideLastSeen {
+		status.LastSeen = nil
+	}
+	return status
+}
+
+// Users online on any node scored by the expiry of their latest connection
+const messengerPresenceOnlineKey = "messenger:presence:online"
+
+func messengerPresenceKey(user int) string {
+	return "messenger:presence:" + strconv.Itoa(user)
+}
+
+func messengerLastSeenKey(user int) string {
+	return "messenger:last_seen:" + strconv.Itoa(user)
+}
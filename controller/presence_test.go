@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"messenger-service/model"
+)
+
+// Connected and disconnected users hiding online status look the same
+func TestMessengerPresencePrivacyHideOnline(t *testing.T) {
+	settings := model.UserSettings{HideOnline: true}
+	seen := time.Now().Add(-time.Hour)
+
+	online := messengerPresencePrivacy(MessengerUserStatus{Id: 1, Status: true}, settings)
+	offline := messengerPresencePrivacy(MessengerUserStatus{Id: 1, Status: false, LastSeen: &seen}, settings)
+	if !reflect.DeepEqual(online, offline) {
+		t.Errorf("online = %+v, offline = %+v, want the same", online, offline)
+	}
+	if online.Status || online.LastSeen != nil {
+		t.Errorf("online = %+v, want offline without last seen", online)
+	}
+
+	// Last seen is still shown to others when online status is not hidden
+	offline = messengerPresencePrivacy(MessengerUserStatus{Id: 1, Status: false, LastSeen: &seen}, model.UserSettings{})
+	if offline.LastSeen == nil {
+		t.Errorf("offline = %+v, want last seen", offline)
+	}
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"messenger-service/database"
+	"messenger-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Message search page size
+const (
+	MessengerSearchLimit    = 20
+	MessengerSearchLimitMax = 50
+)
+
+// Matched words of the snippet are wrapped in <mark>, the rest of the text is HTML-escaped
+const messengerSearchHeadline = "StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5"
+
+// Message search filters, messages are paginated by id from the newest
+type MessengerSearchFilter struct {
+	Query  string
+	Dialog uint
+	From   int
+	Since  int64
+	Until  int64
+	Type   string
+	Before uint
+	Limit  int
+}
+
+type MessengerSearchResult struct {
+	Message MessengerMessage `json:"message"`
+	Snippet string           `json:"snippet"`
+}
+
+type MessengerSearchResults struct {
+	Results []MessengerSearchResult `json:"results"`
+	HasMore bool                    `json:"has_more"`
+}
+
+func MessengerSearchMessages(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	owner, _ := strconv.Atoi(claims["id"].(string))
+
+	filter := MessengerSearchFilter{
+		Query:  c.Query("query"),
+		Dialog: uint(max(c.QueryInt("dialog"), 0)),
+		From:   c.QueryInt("from"),
+		Since:  int64(c.QueryInt("since")),
+		Until:  int64(c.QueryInt("until")),
+		Type:   c.Query("type"),
+		Before: uint(max(c.QueryInt("before"), 0)),
+		Limit:  c.QueryInt("limit"),
+	}
+
+	results, ok := MessengerSearch(owner, filter)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    results,
+	})
+}
+
+// Search messages of dialogs the viewer is a member of, the query matches text messages only,
+// either the query or the type is required
+func MessengerSearch(viewer int, filter MessengerSearchFilter) (MessengerSearchResults, bool) {
+	filter.Query = strings.TrimSpace(filter.Query)
+	if filter.Query == "" && filter.Type == "" {
+		return MessengerSearchResults{}, false
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = MessengerSearchLimit
+	}
+	if limit > MessengerSearchLimitMax {
+		limit = MessengerSearchLimitMax
+	}
+
+	query := database.Postgres.
+		Model(&model.MessengerMessage{}).
+		Where(
+			"dialog_id IN (?)",
+			database.Postgres.Model(&model.MessengerDialogMember{}).Select("dialog_id").Where(&model.MessengerDialogMember{UserID: viewer}),
+		).
+		Where("id NOT IN (?)", MessengerHidden(viewer)).
+		Where("type <> ?", "deleted").
+		Order("id desc").
+		Limit(limit + 1)
+
+	if filter.Query != "" {
+		tsquery := "websearch_to_tsquery('" + database.PostgresSearchConfig + "', ?)"
+		query = query.
+			Select(
+				"id, ts_headline('"+database.PostgresSearchConfig+"', replace(replace(replace(data, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), "+tsquery+", ?) AS snippet",
+				filter.Query,
+				messengerSearchHeadline,
+			).
+			Where("search @@ "+tsquery, filter.Query)
+	} else {
+		query = query.Select("id, '' AS snippet")
+	}
+
+	if filter.Dialog > 0 {
+		query = query.Where("dialog_id = ?", filter.Dialog)
+	}
+	if filter.From > 0 {
+		query = query.Where("from_id = ?", filter.From)
+	}
+	if filter.Since > 0 {
+		query = query.Where("created_at >= ?", time.Unix(filter.Since, 0))
+	}
+	if filter.Until > 0 {
+		query = query.Where("created_at < ?", time.Unix(filter.Until, 0))
+	}
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if filter.Before > 0 {
+		query = query.Where("id < ?", filter.Before)
+	}
+
+	rows := []struct {
+		ID      uint
+		Snippet string
+	}{}
+	query.Scan(&rows)
+
+	hasMore := len(rows) > limit
+	if hasMore {
+		rows = rows[:limit]
+	}
+
+	ids := []uint{}
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+
+	messages := []model.MessengerMessage{}
+	if len(ids) > 0 {
+		database.Postgres.Scopes(MessengerMessagePreload).Where("id IN ?", ids).Find(&messages)
+	}
+
+	byId := map[uint]model.MessengerMessage{}
+	for _, message := range messages {
+		byId[message.ID] = message
+	}
+
+	results := []MessengerSearchResult{}
+	for _, row := range rows {
+		if message, ok := byId[row.ID]; ok {
+			results = append(results, MessengerSearchResult{
+				Message: NewMessengerMessage(message, viewer),
+				Snippet: row.Snippet,
+			})
+		}
+	}
+
+	return MessengerSearchResults{
+		Results: results,
+		HasMore: hasMore,
+	}, true
+}
@@ -0,0 +1,369 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"messenger-service/database"
+	"messenger-service/model"
+	"messenger-service/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Max size of one chunk in bytes, fits the default request body limit
+const MessengerUploadChunkSize = 4 * 1024 * 1024
+
+// Lifetime of unfinished upload
+const MessengerUploadExpire = 24 * time.Hour
+
+// Max number of unfinished uploads of a user
+const MessengerUploadLimit = 10
+
+// Interval of removing expired uploads
+const MessengerUploadCleanupInterval = time.Hour
+
+type MessengerUploadInput struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+type MessengerUploadCompleteInput struct {
+	Checksum string `json:"checksum"`
+}
+
+type MessengerUpload struct {
+	Id        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	ChunkSize int       `json:"chunk_size"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Start upload of a file, chunks are sent to the upload starting from offset 0
+func MessengerUploadCreate(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	owner, _ := strconv.Atoi(claims["id"].(string))
+
+	input := new(MessengerUploadInput)
+	if err := c.BodyParser(input); err != nil || input.Size <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	if limit := MessengerAttachmentSize(); limit > 0 && input.Size > limit {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"status":  "error",
+			"message": "File is too large",
+			"data":    nil,
+		})
+	}
+
+	var count int64
+	database.Postgres.Model(&model.MessengerUpload{}).Where("user_id = ? AND expires_at > ?", owner, time.Now()).Count(&count)
+	if count >= MessengerUploadLimit {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Too many uploads",
+			"data":    nil,
+		})
+	}
+
+	upload := model.MessengerUpload{
+		Uid:       utils.RandomId(),
+		UserID:    owner,
+		Filename:  MessengerAttachmentFilename(input.Filename),
+		Size:      input.Size,
+		ExpiresAt: time.Now().Add(MessengerUploadExpire),
+	}
+	if err := database.Postgres.Create(&upload).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewMessengerUpload(upload),
+	})
+}
+
+// State of the upload, a client resumes sending chunks from the returned offset
+func MessengerUploadGet(c *fiber.Ctx) error {
+	upload, ok := messengerUploadFind(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Upload not found",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewMessengerUpload(upload),
+	})
+}
+
+// Append the request body at ?offset=, which must be the offset received so far
+func MessengerUploadChunk(c *fiber.Ctx) error {
+	upload, ok := messengerUploadFind(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Upload not found",
+			"data":    nil,
+		})
+	}
+
+	chunk := c.Body()
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || len(chunk) == 0 || len(chunk) > MessengerUploadChunkSize || offset+int64(len(chunk)) > upload.Size {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	if offset != upload.Received {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unexpected offset",
+			"data":    NewMessengerUpload(upload),
+		})
+	}
+
+	part := model.MessengerUploadPart{
+		UploadID: upload.ID,
+		Offset:   offset,
+		Size:     int64(len(chunk)),
+		Key:      database.BlobKey("upload"),
+	}
+	if err := database.Blob.Put(part.Key, bytes.NewReader(chunk), part.Size); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	// Concurrent chunks at the same offset, only one of them is kept
+	err = database.Postgres.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.MessengerUpload{}).
+			Where("id = ? AND received = ?", upload.ID, offset).
+			Update("received", gorm.Expr("received + ?", part.Size))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Create(&part).Error
+	})
+	if err != nil {
+		database.Blob.Delete(part.Key)
+		upload, _ = messengerUploadFind(c)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unexpected offset",
+			"data":    NewMessengerUpload(upload),
+		})
+	}
+
+	upload.Received += part.Size
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewMessengerUpload(upload),
+	})
+}
+
+// Join the chunks into an attachment, the SHA-256 checksum of the whole file must match;
+// the returned id is sent as data of a file or image message
+func MessengerUploadComplete(c *fiber.Ctx) error {
+	input := new(MessengerUploadCompleteInput)
+	if err := c.BodyParser(input); err != nil || input.Checksum == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	upload, ok := messengerUploadFind(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Upload not found",
+			"data":    nil,
+		})
+	}
+
+	if upload.Received != upload.Size {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Upload is not finished",
+			"data":    NewMessengerUpload(upload),
+		})
+	}
+
+	parts := []model.MessengerUploadPart{}
+	database.Postgres.
+		Where(&model.MessengerUploadPart{UploadID: upload.ID}).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: "offset"}}).
+		Find(&parts)
+
+	content := &messengerUploadReader{parts: parts}
+	defer content.Close()
+
+	attachment, err := MessengerAttachmentStore(upload.UserID, upload.Filename, content, upload.Size, input.Checksum)
+	if errors.Is(err, ErrMessengerChecksum) {
+		// Chunks are damaged, the upload starts over
+		MessengerUploadDelete(upload)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Checksum mismatch",
+			"data":    nil,
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	MessengerUploadDelete(upload)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewMessengerAttachment(attachment),
+	})
+}
+
+func MessengerUploadAbort(c *fiber.Ctx) error {
+	upload, ok := messengerUploadFind(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Upload not found",
+			"data":    nil,
+		})
+	}
+
+	MessengerUploadDelete(upload)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    nil,
+	})
+}
+
+// Remove the upload with its chunks
+func MessengerUploadDelete(upload model.MessengerUpload) {
+	parts := []model.MessengerUploadPart{}
+	database.Postgres.Where(&model.MessengerUploadPart{UploadID: upload.ID}).Find(&parts)
+	for _, part := range parts {
+		database.Blob.Delete(part.Key)
+	}
+
+	database.Postgres.Unscoped().Where(&model.MessengerUploadPart{UploadID: upload.ID}).Delete(&model.MessengerUploadPart{})
+	database.Postgres.Unscoped().Delete(&upload)
+}
+
+// Remove expired uploads periodically, every node may run it
+func MessengerUploadCleanup() {
+	for range time.Tick(MessengerUploadCleanupInterval) {
+		uploads := []model.MessengerUpload{}
+		database.Postgres.Where("expires_at < ?", time.Now()).Find(&uploads)
+		for _, upload := range uploads {
+			MessengerUploadDelete(upload)
+		}
+	}
+}
+
+// Unexpired upload of the current user by uid from params
+func messengerUploadFind(c *fiber.Ctx) (model.MessengerUpload, bool) {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	owner, _ := strconv.Atoi(claims["id"].(string))
+
+	upload := model.MessengerUpload{}
+	err := database.Postgres.
+		Where("uid = ? AND user_id = ? AND expires_at > ?", c.Params("uid"), owner, time.Now()).
+		First(&upload).Error
+	return upload, err == nil
+}
+
+func NewMessengerUpload(upload model.MessengerUpload) MessengerUpload {
+	return MessengerUpload{
+		Id:        upload.Uid,
+		Filename:  upload.Filename,
+		Size:      upload.Size,
+		Offset:    upload.Received,
+		ChunkSize: MessengerUploadChunkSize,
+		ExpiresAt: upload.ExpiresAt,
+	}
+}
+
+// Chunks of the upload read one after another, each blob is opened when reached
+type messengerUploadReader struct {
+	parts   []model.MessengerUploadPart
+	current io.ReadCloser
+}
+
+func (reader *messengerUploadReader) Read(p []byte) (int, error) {
+	for {
+		if reader.current == nil {
+			if len(reader.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			content, err := database.Blob.Get(reader.parts[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			reader.current = content
+			reader.parts = reader.parts[1:]
+		}
+
+		n, err := reader.current.Read(p)
+		if err == io.EOF {
+			reader.current.Close()
+			reader.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (reader *messengerUploadReader) Close() error {
+	if reader.current == nil {
+		return nil
+	}
+	err := reader.current.Close()
+	reader.current = nil
+	return err
+}
@@ -1,13 +1,70 @@
 package controller
 
 import (
+	"context"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"messenger-service/database"
 	"messenger-service/model"
+	"messenger-service/socketio"
+	"messenger-service/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/text/language"
+	"gorm.io/gorm"
+)
+
+// Lifetime of cached block relations
+const UserBlockExpire = 24 * time.Hour
+
+// User search page size and min length of username prefix
+const (
+	UserSearchLimit     = 20
+	UserSearchLimitMax  = 50
+	UserSearchMinLength = 3
+)
+
+// Profile limits, lengths in characters
+const (
+	UserDisplayNameLength = 64
+	UserBioLength         = 500
+	UserAvatarSize        = 256
+	UserAvatarPixelsMax   = 50000000
 )
 
+// Profile update, omitted fields are left unchanged
+type UserProfileInput struct {
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	Locale      *string `json:"locale"`
+	TimeZone    *string `json:"time_zone"`
+}
+
+// Max length of contact alias in characters
+const UserContactAliasLength = 64
+
+// Contact to add, found by id or username
+type UserContactInput struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	Alias    string `json:"alias"`
+}
+
+// Privacy settings update, omitted fields are left unchanged
+type UserSettingsInput struct {
+	HideLastSeen        *bool   `json:"hide_last_seen"`
+	HideOnline          *bool   `json:"hide_online"`
+	DisableReadReceipts *bool   `json:"disable_read_receipts"`
+	WhoCanMessage       *string `json:"who_can_message"`
+	HideFromSearch      *bool   `json:"hide_from_search"`
+}
+
 type UserCreateOrderInput struct {
 	Pair   int    `json:"pair"`
 	Action string `json:"action"`
@@ -40,6 +97,696 @@ func UserProfile(c *fiber.Ctx) error {
 			"email":    userModel.Email,
 			"role":     userModel.Role,
 			"otp":      userModel.Otp_enabled,
+			"profile":  NewUserProfile(*userModel),
+		},
+	})
+}
+
+// Profile of another user, hidden from users on either side of a block
+func UserProfilePublic(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	profileId, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	userModel := new(model.User)
+	if err := database.Postgres.First(&userModel, profileId).Error; err != nil || slices.Contains(UserBlockIds(id), profileId) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+			"data":    nil,
+		})
+	}
+
+	profile := NewUserProfile(*userModel)
+	profile["user"] = NewMessengerContact(*userModel, UserContactsFind(id))
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    profile,
+	})
+}
+
+func UserProfileUpdate(c *fiber.Ctx) error {
+	input := new(UserProfileInput)
+	if err := c.BodyParser(input); err != nil || !userProfileValid(input) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	updates := map[string]interface{}{}
+	if input.DisplayName != nil {
+		updates["display_name"] = strings.TrimSpace(*input.DisplayName)
+	}
+	if input.Bio != nil {
+		updates["bio"] = strings.TrimSpace(*input.Bio)
+	}
+	if input.Locale != nil {
+		updates["locale"] = *input.Locale
+	}
+	if input.TimeZone != nil {
+		updates["time_zone"] = *input.TimeZone
+	}
+
+	return userProfileSave(c, claims["id"].(string), updates)
+}
+
+// Store the avatar cropped to a square and resized to the avatar size
+func UserAvatarUpload(c *fiber.Ctx) error {
+	file, err := c.FormFile("avatar")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+	defer content.Close()
+
+	raw, err := io.ReadAll(content)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	// Dimensions are checked before decoding to refuse decompression bombs
+	src, _, err := utils.ImageDecode(raw, UserAvatarPixelsMax)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unsupported image",
+			"data":    nil,
+		})
+	}
+
+	square, _, err := utils.ImageEncode(utils.ImageSquare(src, UserAvatarSize), "png")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	avatar, err := MessengerImageStore(square)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	return userProfileSave(c, claims["id"].(string), map[string]interface{}{"avatar": avatar.Uid})
+}
+
+func UserAvatarRemove(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	return userProfileSave(c, claims["id"].(string), map[string]interface{}{"avatar": ""})
+}
+
+// Update the profile, drop the replaced avatar and push the user to peers
+func userProfileSave(c *fiber.Ctx, id string, updates map[string]interface{}) error {
+	userModel := new(model.User)
+	if err := database.Postgres.First(&userModel, id).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+	avatar := userModel.Avatar
+
+	if len(updates) > 0 {
+		if err := database.Postgres.Model(&model.User{}).Where("id = ?", userModel.ID).Updates(updates).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Internal server error",
+				"data":    nil,
+			})
+		}
+		database.Postgres.First(&userModel, userModel.ID)
+	}
+
+	if _, ok := updates["avatar"]; ok && avatar != "" {
+		MessengerImageDelete(avatar)
+	}
+
+	// Payloads embed the user, let peers refresh it
+	blocks := UserBlockIds(int(userModel.ID))
+	for _, peer := range MessengerPeerIds(int(userModel.ID)) {
+		if !slices.Contains(blocks, peer) {
+			socketio.Emit(strconv.Itoa(peer), "user_updated", NewMessengerUser(*userModel))
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewUserProfile(*userModel),
+	})
+}
+
+func userProfileValid(input *UserProfileInput) bool {
+	if input.DisplayName != nil && utf8.RuneCountInString(strings.TrimSpace(*input.DisplayName)) > UserDisplayNameLength {
+		return false
+	}
+	if input.Bio != nil && utf8.RuneCountInString(strings.TrimSpace(*input.Bio)) > UserBioLength {
+		return false
+	}
+	if input.Locale != nil && *input.Locale != "" {
+		if _, err := language.Parse(*input.Locale); err != nil {
+			return false
+		}
+	}
+	if input.TimeZone != nil && *input.TimeZone != "" {
+		if _, err := time.LoadLocation(*input.TimeZone); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func NewUserProfile(user model.User) fiber.Map {
+	messengerUser := NewMessengerUser(user)
+	return fiber.Map{
+		"display_name": user.DisplayName,
+		"bio":          user.Bio,
+		"avatar":       messengerUser.Avatar,
+		"locale":       user.Locale,
+		"time_zone":    user.TimeZone,
+	}
+}
+
+func UserSettingsGet(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewUserSettings(UserSettingsFind(id)),
+	})
+}
+
+func UserSettingsUpdate(c *fiber.Ctx) error {
+	input := new(UserSettingsInput)
+	if err := c.BodyParser(input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	if input.WhoCanMessage != nil && !slices.Contains(
+		[]string{model.UserMessageEveryone, model.UserMessageContacts, model.UserMessageNobody},
+		*input.WhoCanMessage,
+	) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	settings := UserSettingsFind(id)
+	if input.HideLastSeen != nil {
+		settings.HideLastSeen = *input.HideLastSeen
+	}
+	if input.HideOnline != nil {
+		settings.HideOnline = *input.HideOnline
+	}
+	if input.DisableReadReceipts != nil {
+		settings.DisableReadReceipts = *input.DisableReadReceipts
+	}
+	if input.WhoCanMessage != nil {
+		settings.WhoCanMessage = *input.WhoCanMessage
+	}
+	if input.HideFromSearch != nil {
+		settings.HideFromSearch = *input.HideFromSearch
+	}
+
+	if err := database.Postgres.Save(&settings).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	// Show peers presence under the new settings
+	MessengerPresencePush(id, MessengerPresence(id, []int{id})[0])
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    NewUserSettings(settings),
+	})
+}
+
+// Settings of the user, defaults if the user never changed them
+func UserSettingsFind(user int) model.UserSettings {
+	return UserSettingsFindMany([]int{user})[user]
+}
+
+// Settings of the users by id, defaults for users who never changed them
+func UserSettingsFindMany(users []int) map[int]model.UserSettings {
+	rows := []model.UserSettings{}
+	database.Postgres.Where("user_id IN ?", users).Find(&rows)
+
+	settings := map[int]model.UserSettings{}
+	for _, user := range users {
+		settings[user] = model.UserSettings{
+			UserID:        user,
+			WhoCanMessage: model.UserMessageEveryone,
+		}
+	}
+	for _, row := range rows {
+		settings[row.UserID] = row
+	}
+	return settings
+}
+
+func NewUserSettings(settings model.UserSettings) fiber.Map {
+	return fiber.Map{
+		"hide_last_seen":        settings.HideLastSeen,
+		"hide_online":           settings.HideOnline,
+		"disable_read_receipts": settings.DisableReadReceipts,
+		"who_can_message":       settings.WhoCanMessage,
+		"hide_from_search":      settings.HideFromSearch,
+	}
+}
+
+func UserBlockedList(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    UserBlockedFind(id),
+	})
+}
+
+func UserBlockAdd(c *fiber.Ctx) error {
+	return userBlockUpdate(c, true)
+}
+
+func UserBlockRemove(c *fiber.Ctx) error {
+	return userBlockUpdate(c, false)
+}
+
+func userBlockUpdate(c *fiber.Ctx, block bool) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	blocked, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	if block {
+		err = UserBlock(id, blocked)
+	} else {
+		UserUnblock(id, blocked)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    UserBlockedFind(id),
+	})
+}
+
+// Block the user and push the blocked list to every connection of the blocker
+func UserBlock(user int, blocked int) error {
+	if user == blocked {
+		return gorm.ErrRecordNotFound
+	}
+
+	if err := database.Postgres.First(new(model.User), blocked).Error; err != nil {
+		return err
+	}
+
+	block := model.UserBlock{UserID: user, BlockedID: blocked}
+	if err := database.Postgres.Where(&block).FirstOrCreate(&block).Error; err != nil {
+		return err
+	}
+
+	userBlockChanged(user, blocked)
+	return nil
+}
+
+// Unblock the user and push the blocked list to every connection of the blocker
+func UserUnblock(user int, blocked int) {
+	database.Postgres.Unscoped().Where(&model.UserBlock{UserID: user, BlockedID: blocked}).Delete(&model.UserBlock{})
+
+	userBlockChanged(user, blocked)
+}
+
+func userBlockChanged(user int, blocked int) {
+	ctx := context.Background()
+	database.Redis[0].Del(ctx, userBlockKey(user), userBlockKey(blocked))
+
+	socketio.Emit(strconv.Itoa(user), "user_blocked", UserBlockedFind(user))
+
+	// Presence of the blocker as the blocked user sees it now
+	socketio.Emit(strconv.Itoa(blocked), "presence_changed", MessengerPresence(blocked, []int{user})[0])
+}
+
+// Users blocked by the user
+func UserBlockedFind(user int) []MessengerUser {
+	blocks := []model.UserBlock{}
+	database.Postgres.Where(&model.UserBlock{UserID: user}).Preload("Blocked").Order("id asc").Find(&blocks)
+
+	users := []MessengerUser{}
+	for _, block := range blocks {
+		users = append(users, NewMessengerUser(block.Blocked))
+	}
+	return users
+}
+
+// Users who block the user or are blocked by the user, cached in Redis
+func UserBlockIds(user int) []int {
+	ctx := context.Background()
+	ids := []int{}
+
+	if cached, err := database.Redis[0].Get(ctx, userBlockKey(user)).Result(); err == nil {
+		for _, value := range strings.Split(cached, ",") {
+			if id, err := strconv.Atoi(value); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	blocks := []model.UserBlock{}
+	database.Postgres.Where("user_id = ? OR blocked_id = ?", user, user).Find(&blocks)
+
+	values := []string{}
+	for _, block := range blocks {
+		id := block.BlockedID
+		if id == user {
+			id = block.UserID
+		}
+
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+			values = append(values, strconv.Itoa(id))
+		}
+	}
+
+	database.Redis[0].Set(ctx, userBlockKey(user), strings.Join(values, ","), UserBlockExpire)
+
+	return ids
+}
+
+func userBlockKey(user int) string {
+	return "messenger:blocks:" + strconv.Itoa(user)
+}
+
+func UserContactsList(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    UserContactsListFind(id),
+	})
+}
+
+func UserContactAdd(c *fiber.Ctx) error {
+	input := new(UserContactInput)
+	if err := c.BodyParser(input); err != nil || utf8.RuneCountInString(input.Alias) > UserContactAliasLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	// Blocked users and users hidden from search by username are not found, like in search
+	contactModel := new(model.User)
+	query := database.Postgres.Where("id = ?", input.Id)
+	if input.Username != "" {
+		query = database.Postgres.Where(&model.User{Username: input.Username})
+	}
+	err := query.First(&contactModel).Error
+	if err != nil || int(contactModel.ID) == id || slices.Contains(UserBlockIds(id), int(contactModel.ID)) ||
+		input.Username != "" && UserSettingsFind(int(contactModel.ID)).HideFromSearch {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+			"data":    nil,
+		})
+	}
+
+	contact := model.UserContact{UserID: id, ContactID: int(contactModel.ID)}
+	if err := database.Postgres.Where(&contact).Assign(model.UserContact{Alias: input.Alias}).FirstOrCreate(&contact).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Internal server error",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    UserContactsListFind(id),
+	})
+}
+
+func UserContactUpdate(c *fiber.Ctx) error {
+	input := new(UserContactInput)
+	contactId, err := c.ParamsInt("id")
+	if err != nil || c.BodyParser(input) != nil || utf8.RuneCountInString(input.Alias) > UserContactAliasLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	result := database.Postgres.
+		Model(&model.UserContact{}).
+		Where(&model.UserContact{UserID: id, ContactID: contactId}).
+		Update("alias", input.Alias)
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Contact not found",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    UserContactsListFind(id),
+	})
+}
+
+func UserContactRemove(c *fiber.Ctx) error {
+	contactId, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	database.Postgres.Unscoped().Where(&model.UserContact{UserID: id, ContactID: contactId}).Delete(&model.UserContact{})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data":    UserContactsListFind(id),
+	})
+}
+
+// Contacts of the user by contact id
+func UserContactsFind(user int) map[int]model.UserContact {
+	rows := []model.UserContact{}
+	database.Postgres.Where(&model.UserContact{UserID: user}).Find(&rows)
+
+	contacts := map[int]model.UserContact{}
+	for _, row := range rows {
+		contacts[row.ContactID] = row
+	}
+	return contacts
+}
+
+// Contacts of every user by user id, then by contact id
+func UserContactsFindMany(users []int) map[int]map[int]model.UserContact {
+	rows := []model.UserContact{}
+	database.Postgres.Where("user_id IN ?", users).Find(&rows)
+
+	contacts := map[int]map[int]model.UserContact{}
+	for _, user := range users {
+		contacts[user] = map[int]model.UserContact{}
+	}
+	for _, row := range rows {
+		contacts[row.UserID][row.ContactID] = row
+	}
+	return contacts
+}
+
+// Address book of the user ordered by alias, then by username
+func UserContactsListFind(user int) []MessengerUser {
+	rows := []model.UserContact{}
+	database.Postgres.Where(&model.UserContact{UserID: user}).Preload("Contact").Order("id asc").Find(&rows)
+
+	contacts := []MessengerUser{}
+	for _, row := range rows {
+		contact := NewMessengerUser(row.Contact)
+		contact.Contact = true
+		contact.Alias = row.Alias
+		contacts = append(contacts, contact)
+	}
+	slices.SortStableFunc(contacts, func(a MessengerUser, b MessengerUser) int {
+		return strings.Compare(strings.ToLower(userContactName(a)), strings.ToLower(userContactName(b)))
+	})
+	return contacts
+}
+
+func userContactName(user MessengerUser) string {
+	if user.Alias != "" {
+		return user.Alias
+	}
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	return user.Username
+}
+
+// Search users by username prefix or exact email, users hidden from search
+// and users on either side of a block are skipped
+func UserSearch(c *fiber.Ctx) error {
+	query := strings.TrimSpace(c.Query("query"))
+	if utf8.RuneCountInString(query) < UserSearchMinLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"data":    nil,
+		})
+	}
+
+	limit := c.QueryInt("limit", UserSearchLimit)
+	if limit <= 0 {
+		limit = UserSearchLimit
+	}
+	if limit > UserSearchLimitMax {
+		limit = UserSearchLimitMax
+	}
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, _ := strconv.Atoi(claims["id"].(string))
+
+	excluded := append(UserBlockIds(id), id)
+	prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(query)) + "%"
+
+	users := []model.User{}
+	database.Postgres.
+		Where("id NOT IN ?", excluded).
+		Where(
+			"id NOT IN (?)",
+			database.Postgres.Model(&model.UserSettings{}).Select("user_id").Where("hide_from_search = ?", true),
+		).
+		Where(`(LOWER(username) LIKE ? ESCAPE '\' OR LOWER(email) = ?)`, prefix, strings.ToLower(query)).
+		Order("username asc").
+		Offset((page - 1) * limit).
+		Limit(limit + 1).
+		Find(&users)
+
+	hasMore := len(users) > limit
+	if hasMore {
+		users = users[:limit]
+	}
+
+	contacts := UserContactsFind(id)
+	result := []MessengerUser{}
+	for _, user := range users {
+		result = append(result, NewMessengerContact(user, contacts))
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": nil,
+		"data": fiber.Map{
+			"users":    result,
+			"has_more": hasMore,
 		},
 	})
 }
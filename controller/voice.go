@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"messenger-service/config"
+	"messenger-service/database"
+	"messenger-service/model"
+	"messenger-service/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Number of values in the waveform of voice message
+const MessengerVoiceWaveformLength = 100
+
+// Content type of served voice messages
+const MessengerVoiceMimeType = "audio/ogg; codecs=opus"
+
+// Audio of voice message behind a signed url, see MessengerVoiceUrl;
+// a byte range may be requested so clients can seek
+func MessengerMessageVoice(c *fiber.Ctx) error {
+	attachment := new(model.MessengerAttachment)
+	if err := database.Postgres.Where("uid = ?", c.Params("uid")).First(&attachment).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Voice message not found",
+			"data":    nil,
+		})
+	}
+
+	c.Set("Content-Type", MessengerVoiceMimeType)
+	return messengerBlobSend(c, attachment.Key, attachment.Size)
+}
+
+// Check the uploaded file is Opus audio in Ogg within the duration limit and describe it
+// for message metadata, the waveform is computed once here so clients can draw it at once
+func MessengerVoiceMetadata(attachment model.MessengerAttachment) (string, bool) {
+	if attachment.MimeType != "application/ogg" {
+		return "", false
+	}
+
+	content, err := database.Blob.Get(attachment.Key)
+	if err != nil {
+		return "", false
+	}
+	defer content.Close()
+
+	audio, err := utils.OggOpusRead(content, MessengerVoiceDuration())
+	if err != nil {
+		return "", false
+	}
+
+	metadata, _ := json.Marshal(struct {
+		Duration float64 `json:"duration"`
+		Waveform []int   `json:"waveform"`
+		MimeType string  `json:"mime_type"`
+		Size     int64   `json:"size"`
+	}{
+		math.Round(audio.Duration.Seconds()*1000) / 1000,
+		utils.OpusWaveform(audio.Packets, MessengerVoiceWaveformLength),
+		MessengerVoiceMimeType,
+		attachment.Size,
+	})
+	return string(metadata), true
+}
+
+// Max duration of voice message, 0 to rely on the attachment size limit only
+func MessengerVoiceDuration() time.Duration {
+	seconds, _ := strconv.Atoi(config.Config("MESSENGER_VOICE_DURATION"))
+	return time.Duration(seconds) * time.Second
+}
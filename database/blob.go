@@ -0,0 +1,52 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"messenger-service/config"
+	"messenger-service/utils"
+)
+
+// Storage of media content, rows keep only the key of the blob
+type BlobStore interface {
+	Put(key string, data io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, error)
+	// Part of the content of the given length starting at the offset
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+var Blob BlobStore
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+func BlobConnect() {
+	switch config.Config("BLOB_DRIVER") {
+	case "s3":
+		Blob = &S3BlobStore{
+			Endpoint:  config.Config("S3_ENDPOINT"),
+			Region:    config.Config("S3_REGION"),
+			Bucket:    config.Config("S3_BUCKET"),
+			AccessKey: config.Config("S3_ACCESS_KEY"),
+			SecretKey: config.Config("S3_SECRET_KEY"),
+			Client:    &http.Client{Timeout: 5 * time.Minute},
+		}
+		log.Printf("Blob store opened on S3")
+	default:
+		path := config.Config("BLOB_PATH")
+		if path == "" {
+			path = "storage"
+		}
+		Blob = &LocalBlobStore{Root: path}
+		log.Printf("Blob store opened in %s", path)
+	}
+}
+
+// New random key under the prefix
+func BlobKey(prefix string) string {
+	return prefix + "/" + utils.RandomId()
+}
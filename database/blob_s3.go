@@ -0,0 +1,198 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload hash of requests whose body is not signed
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Blobs stored in a bucket of S3 or a compatible service,
+// objects are addressed path-style: <endpoint>/<bucket>/<key>
+type S3BlobStore struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (store *S3BlobStore) Put(key string, data io.Reader, size int64) error {
+	request, err := store.request(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+
+	response, err := store.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (store *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	request, err := store.request(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := store.do(request)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (store *S3BlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	request, err := store.request(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	response, err := store.do(request)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (store *S3BlobStore) Delete(key string) error {
+	request, err := store.request(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := store.do(request)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (store *S3BlobStore) request(method string, key string, body io.Reader) (*http.Request, error) {
+	endpoint := strings.TrimSuffix(store.Endpoint, "/")
+	request, err := http.NewRequest(method, endpoint+"/"+s3Escape(store.Bucket+"/"+key), body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	return request, nil
+}
+
+// Sign and send the request, responses other than 2xx are errors
+func (store *S3BlobStore) do(request *http.Request) (*http.Response, error) {
+	s3Sign(request, store.Region, store.AccessKey, store.SecretKey, time.Now())
+
+	response, err := store.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", request.Method, request.URL.Path, response.Status, message)
+	}
+
+	return response, nil
+}
+
+// Sign the request with AWS Signature Version 4, the host and all x-amz-* and range headers are signed,
+// X-Amz-Content-Sha256 must be set beforehand
+func s3Sign(request *http.Request, region string, accessKey string, secretKey string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		request.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := s3Hmac([]byte("AWS4"+secretKey), date)
+	key = s3Hmac(key, region)
+	key = s3Hmac(key, "s3")
+	key = s3Hmac(key, "aws4_request")
+	signature := hex.EncodeToString(s3Hmac(key, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Escape every byte except unreserved characters and slashes
+func s3Escape(path string) string {
+	escaped := strings.Builder{}
+	for _, b := range []byte(path) {
+		if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || strings.IndexByte("-_.~/", b) >= 0 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name)+"="+strings.ReplaceAll(s3Escape(value), "/", "%2F"))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,366 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+
+	"messenger-service/model"
+
+	"gorm.io/gorm"
+)
+
+// Indexes that can not be described with model tags
+func postgresMigrateIndexes() {
+	// Message history is paginated by id inside a dialog
+	Postgres.Exec("CREATE INDEX IF NOT EXISTS idx_messenger_messages_dialog ON messenger_messages (dialog_id, id)")
+}
+
+// Fill unread counters of members from receipts, once the counter column is added
+func postgresMigrateUnread() {
+	err := Postgres.Exec(`
+		UPDATE messenger_dialog_members SET unread = (
+			SELECT COUNT(*) FROM messenger_receipts
+			JOIN messenger_messages ON messenger_messages.id = messenger_receipts.message_id
+			WHERE messenger_receipts.user_id = messenger_dialog_members.user_id
+				AND messenger_messages.dialog_id = messenger_dialog_members.dialog_id
+				AND messenger_messages.from_id <> messenger_receipts.user_id
+				AND messenger_messages.type <> 'deleted'
+				AND messenger_messages.deleted_at IS NULL
+				AND messenger_receipts.read_at IS NULL
+				AND messenger_receipts.hidden = false
+				AND messenger_receipts.deleted_at IS NULL
+		)
+	`).Error
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate messenger unread counters: %v", err))
+	}
+}
+
+// Text search configuration of the message search column, queries must use the same one
+const PostgresSearchConfig = "simple"
+
+// Full-text search over text messages, the column follows edits and deletes by itself
+func postgresMigrateSearch() {
+	Postgres.Exec("ALTER TABLE messenger_messages ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (to_tsvector('" + PostgresSearchConfig + "', CASE WHEN type = 'text' THEN data ELSE '' END)) STORED")
+	Postgres.Exec("CREATE INDEX IF NOT EXISTS idx_messenger_messages_search ON messenger_messages USING GIN (search)")
+}
+
+// Tables whose content moved from the data column to the blob store,
+// images were kept as base64 text
+var blobTables = []struct {
+	model  interface{}
+	table  string
+	prefix string
+	base64 bool
+}{
+	{&model.MessengerImage{}, "messenger_images", "image", true},
+	{&model.MessengerAttachment{}, "messenger_attachments", "attachment", false},
+}
+
+// New rows keep content in the blob store only, the data column stays until moved by BlobMigrate
+func postgresMigrateBlobs() {
+	for _, blob := range blobTables {
+		if Postgres.Migrator().HasColumn(blob.model, "data") {
+			Postgres.Exec("ALTER TABLE " + blob.table + " ALTER COLUMN data DROP NOT NULL")
+		}
+	}
+}
+
+// Move content kept in Postgres rows to the blob store, the data column
+// is dropped once every row of the table is moved
+func BlobMigrate() (int, error) {
+	moved := 0
+	for _, blob := range blobTables {
+		if !Postgres.Migrator().HasColumn(blob.model, "data") {
+			continue
+		}
+
+		for {
+			rows := []struct {
+				ID   uint
+				Data []byte
+			}{}
+			if err := Postgres.Table(blob.table).Select("id, data").Where("data IS NOT NULL").Order("id asc").Limit(100).Find(&rows).Error; err != nil {
+				return moved, err
+			}
+			if len(rows) == 0 {
+				break
+			}
+
+			for _, row := range rows {
+				content := row.Data
+				if blob.base64 {
+					// Served as decoded so far, damaged tails included
+					content, _ = base64.StdEncoding.DecodeString(string(row.Data))
+				}
+
+				key := BlobKey(blob.prefix)
+				if err := Blob.Put(key, bytes.NewReader(content), int64(len(content))); err != nil {
+					return moved, err
+				}
+
+				err := Postgres.Table(blob.table).Where("id = ?", row.ID).Updates(map[string]interface{}{"key": key, "data": nil}).Error
+				if err != nil {
+					Blob.Delete(key)
+					return moved, err
+				}
+				moved++
+			}
+		}
+
+		if err := Postgres.Migrator().DropColumn(blob.model, "data"); err != nil {
+			return moved, err
+		}
+	}
+
+	return moved, nil
+}
+
+// Give media random uids in place of sequential ids in messages and avatars,
+// once the uid column is added
+func postgresMigrateMediaUids() {
+	err := Postgres.Transaction(func(tx *gorm.DB) error {
+		for _, media := range []struct {
+			table string
+			_type string
+		}{
+			{"messenger_images", "image"},
+			{"messenger_attachments", "file"},
+		} {
+			if err := tx.Exec("UPDATE " + media.table + " SET uid = replace(gen_random_uuid()::text, '-', '') WHERE uid IS NULL").Error; err != nil {
+				return err
+			}
+
+			err := tx.Exec(
+				"UPDATE messenger_messages SET data = media.uid FROM "+media.table+" media WHERE messenger_messages.type = ? AND messenger_messages.data = media.id::text",
+				media._type,
+			).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if !tx.Migrator().HasColumn(&model.User{}, "avatar_id") {
+			return nil
+		}
+		if err := tx.Exec("UPDATE users SET avatar = messenger_images.uid FROM messenger_images WHERE users.avatar_id = messenger_images.id").Error; err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&model.User{}, "avatar_id")
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate media uids: %v", err))
+	}
+}
+
+// Message row before receipts were introduced, every direct message was stored
+// twice: once in the dialog of the sender and once in the dialog of the recipient
+type legacyMessengerMessage struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	FromID    int
+	ToID      *int
+	Type      string
+	Data      string
+	DialogID  uint
+	Read      bool
+}
+
+// Content identifying copies of one legacy message
+type legacyMessengerMessageKey struct {
+	FromID int
+	Type   string
+	Data   string
+}
+
+// Collapse per-owner dialogs and duplicated messages into shared dialogs
+// with one message row and per-user receipts
+func postgresMigrateReceipts() {
+	if !Postgres.Migrator().HasColumn(&model.MessengerMessage{}, "read") {
+		return
+	}
+
+	err := Postgres.Transaction(func(tx *gorm.DB) error {
+		dialogs := []model.MessengerDialog{}
+		if err := tx.Order("id asc").Find(&dialogs).Error; err != nil {
+			return err
+		}
+
+		// Group direct dialogs by pair of users
+		pairs := map[string][]model.MessengerDialog{}
+		order := []string{}
+		for _, dialog := range dialogs {
+			if dialog.Type == model.MessengerDialogGroup {
+				if err := migrateMessengerGroupReceipts(tx, dialog); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if dialog.UserID == nil {
+				continue
+			}
+
+			low, high := dialog.OwnerID, *dialog.UserID
+			if low > high {
+				low, high = high, low
+			}
+
+			key := fmt.Sprintf("%d:%d", low, high)
+			if _, ok := pairs[key]; !ok {
+				order = append(order, key)
+			}
+			pairs[key] = append(pairs[key], dialog)
+		}
+
+		for _, key := range order {
+			if err := migrateMessengerDirectDialog(tx, pairs[key]); err != nil {
+				return err
+			}
+		}
+
+		return tx.Migrator().DropColumn(&model.MessengerMessage{}, "read")
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate messenger receipts: %v", err))
+	}
+
+	log.Printf("Messenger messages collapsed into receipts")
+}
+
+func migrateMessengerDirectDialog(tx *gorm.DB, dialogs []model.MessengerDialog) error {
+	canonical := dialogs[0]
+	users := []int{canonical.OwnerID, *canonical.UserID}
+
+	// Message copies of every message, by owner of the copy
+	copies := map[uint]map[int]legacyMessengerMessage{}
+	messages := []legacyMessengerMessage{}
+	twins := []uint{}
+
+	for _, dialog := range dialogs {
+		rows := []legacyMessengerMessage{}
+		if err := tx.Table("messenger_messages").Where("dialog_id = ? AND deleted_at IS NULL", dialog.ID).Order("id asc").Find(&rows).Error; err != nil {
+			return err
+		}
+
+		// Messages without a copy of this owner yet, both copies were written in the same order
+		// so twins are matched in one pass over queues of messages with the same content
+		pending := map[legacyMessengerMessageKey][]legacyMessengerMessage{}
+		for _, message := range messages {
+			if _, ok := copies[message.ID][dialog.OwnerID]; !ok {
+				key := legacyMessengerMessageKey{message.FromID, message.Type, message.Data}
+				pending[key] = append(pending[key], message)
+			}
+		}
+
+		for _, row := range rows {
+			// Look for the twin stored in another dialog, older candidates cannot match later rows
+			key := legacyMessengerMessageKey{row.FromID, row.Type, row.Data}
+			queue := pending[key]
+			for len(queue) > 0 && row.CreatedAt.Sub(queue[0].CreatedAt) >= time.Minute {
+				queue = queue[1:]
+			}
+
+			twin := uint(0)
+			if len(queue) > 0 && queue[0].CreatedAt.Sub(row.CreatedAt) < time.Minute {
+				twin = queue[0].ID
+				queue = queue[1:]
+			}
+			pending[key] = queue
+
+			if twin == 0 {
+				messages = append(messages, row)
+				copies[row.ID] = map[int]legacyMessengerMessage{dialog.OwnerID: row}
+				continue
+			}
+
+			copies[twin][dialog.OwnerID] = row
+			twins = append(twins, row.ID)
+		}
+	}
+
+	// Drop duplicated dialogs and messages
+	for _, dialog := range dialogs[1:] {
+		if err := tx.Exec("DELETE FROM messenger_dialogs WHERE id = ?", dialog.ID).Error; err != nil {
+			return err
+		}
+	}
+	if len(twins) > 0 {
+		if err := tx.Exec("DELETE FROM messenger_messages WHERE id IN ?", twins).Error; err != nil {
+			return err
+		}
+	}
+
+	var last *uint
+	for _, message := range messages {
+		if err := tx.Table("messenger_messages").Where("id = ?", message.ID).Update("dialog_id", canonical.ID).Error; err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			receipt := model.MessengerReceipt{
+				MessageID: message.ID,
+				UserID:    user,
+			}
+
+			if user == message.FromID {
+				receipt.DeliveredAt = &message.CreatedAt
+				receipt.ReadAt = &message.CreatedAt
+			} else if row, ok := copies[message.ID][user]; ok && row.Read {
+				receipt.DeliveredAt = &row.UpdatedAt
+				receipt.ReadAt = &row.UpdatedAt
+			}
+
+			if err := tx.Create(&receipt).Error; err != nil {
+				return err
+			}
+		}
+
+		if last == nil || message.ID > *last {
+			id := message.ID
+			last = &id
+		}
+	}
+
+	if err := tx.Model(&model.MessengerDialog{}).Where("id = ?", canonical.ID).Update("message_id", last).Error; err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		member := model.MessengerDialogMember{
+			DialogID: canonical.ID,
+			UserID:   user,
+			Role:     model.MessengerRoleMember,
+		}
+		if err := tx.Where(&model.MessengerDialogMember{DialogID: canonical.ID, UserID: user}).FirstOrCreate(&member).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateMessengerGroupReceipts(tx *gorm.DB, dialog model.MessengerDialog) error {
+	rows := []legacyMessengerMessage{}
+	if err := tx.Table("messenger_messages").Where("dialog_id = ? AND deleted_at IS NULL", dialog.ID).Find(&rows).Error; err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		receipt := model.MessengerReceipt{
+			MessageID:   row.ID,
+			UserID:      row.FromID,
+			DeliveredAt: &row.CreatedAt,
+			ReadAt:      &row.CreatedAt,
+		}
+		if err := tx.Create(&receipt).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
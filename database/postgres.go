@@ -27,11 +27,34 @@ func PostgresConnect() {
 	}
 
 	log.Printf("Connection opened to Postgres")
+	unread := Postgres.Migrator().HasColumn(&model.MessengerDialogMember{}, "unread")
+	uids := Postgres.Migrator().HasColumn(&model.MessengerImage{}, "uid")
 	Postgres.AutoMigrate(
 		&model.User{},
+		&model.UserSettings{},
+		&model.UserBlock{},
+		&model.UserContact{},
 		&model.MessengerDialog{},
+		&model.MessengerDialogMember{},
 		&model.MessengerMessage{},
+		&model.MessengerReceipt{},
+		&model.MessengerMessageEdit{},
+		&model.MessengerReaction{},
 		&model.MessengerImage{},
+		&model.MessengerAttachment{},
+		&model.MessengerUpload{},
+		&model.MessengerUploadPart{},
+		&model.MessengerBlob{},
 	)
+	postgresMigrateReceipts()
+	if !unread {
+		postgresMigrateUnread()
+	}
+	postgresMigrateIndexes()
+	postgresMigrateSearch()
+	postgresMigrateBlobs()
+	if !uids {
+		postgresMigrateMediaUids()
+	}
 	log.Printf("Postgres Database Migrated")
 }
@@ -16,6 +16,8 @@ require (
 	github.com/zishang520/socket.io-go-redis v0.0.0-beta.4
 	github.com/zishang520/socket.io/v2 v2.2.2
 	golang.org/x/crypto v0.26.0
+	golang.org/x/image v0.18.0
+	golang.org/x/text v0.17.0
 	gorm.io/driver/postgres v1.5.9
 	gorm.io/gorm v1.25.11
 )
@@ -70,7 +72,6 @@ require (
 	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
-	golang.org/x/text v0.17.0 // indirect
 	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 	gorm.io/driver/mysql v1.5.6 // indirect
 	gorm.io/driver/sqlserver v1.5.3 // indirect
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"log"
 	"messenger-service/config"
+	"messenger-service/controller"
 	"messenger-service/database"
 	"messenger-service/event"
 	"messenger-service/event/listener"
 	"messenger-service/router"
 	"messenger-service/socketio"
+	"messenger-service/utils"
 	"os"
 	"os/signal"
 	"syscall"
@@ -24,12 +26,17 @@ func main() {
 		DisableStartupMessage: true,
 		StrictRouting:         true,
 		AppName:               "messenger-service",
+		// Leave room for multipart overhead of the largest attachment
+		BodyLimit: max(int(controller.MessengerAttachmentSize())+1024*1024, fiber.DefaultBodyLimit),
 	})
 
 	rest.Use(cors.New())
 
 	database.RedisConnect()
 	database.PostgresConnect()
+	database.BlobConnect()
+
+	utils.UrlSignatureInit()
 
 	event.RabbitMQConnect([]string{
 		// Connect to queues
@@ -40,6 +47,14 @@ func main() {
 	// Run "ome" listener
 	go listener.Api()
 
+	// Remove expired uploads, unsent files and unreferenced media
+	go controller.MessengerUploadCleanup()
+	go controller.MessengerAttachmentCleanup()
+	go controller.MessengerBlobCleanup()
+
+	// Push offline users of crashed nodes
+	go controller.MessengerPresenceSweep()
+
 	// Subscribe listener channel to "api" events
 	event.RabbitMQSubscribe([]event.RabbitMQSubscribeListener{
 		{
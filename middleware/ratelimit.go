@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"messenger-service/database"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// Limit requests of the user to max per window, counted in Redis across all nodes,
+// 0 to disable the limit
+func RateLimit(name string, max int, window time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if max <= 0 {
+			return c.Next()
+		}
+
+		user := c.Locals("user").(*jwt.Token)
+		claims := user.Claims.(jwt.MapClaims)
+
+		ctx := context.Background()
+		key := "ratelimit:" + name + ":" + claims["id"].(string)
+
+		var count *redis.IntCmd
+		var ttl *redis.DurationCmd
+		_, err := database.Redis[0].TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			count = pipe.Incr(ctx, key)
+			pipe.ExpireNX(ctx, key, window)
+			ttl = pipe.TTL(ctx, key)
+			return nil
+		})
+
+		if err == nil && count.Val() > int64(max) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(ttl.Val().Seconds())+1))
+			return c.Status(fiber.StatusTooManyRequests).
+				JSON(fiber.Map{
+					"status":  "error",
+					"message": "Too many requests",
+					"data":    nil,
+				})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"messenger-service/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Allow requests to urls signed with utils.SignUrl until they expire
+func SignedUrl() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !utils.CheckUrlSignature(c.Path(), c.Query("expires"), c.Query("signature")) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid or expired signature",
+				"data":    nil,
+			})
+		}
+		return c.Next()
+	}
+}
@@ -1,31 +1,145 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Dialog types
+const (
+	MessengerDialogDirect = "direct"
+	MessengerDialogGroup  = "group"
+)
+
+// Dialog member roles
+const (
+	MessengerRoleOwner  = "owner"
+	MessengerRoleAdmin  = "admin"
+	MessengerRoleMember = "member"
+)
 
 type MessengerDialog struct {
 	gorm.Model
+	Type      string `gorm:"not null; default:direct" json:"type"`
+	Title     string `json:"title"`
 	OwnerID   int
-	UserID    int
-	MessageID int
-	Owner     User             `gorm:"not null; foreignKey:OwnerID" json:"owner"`
-	User      User             `gorm:"not null; foreignKey:UserID" json:"user"`
-	Message   MessengerMessage `gorm:"not null; foreignKey:MessageID" json:"message"`
+	UserID    *int
+	MessageID *uint
+	Owner     User                    `gorm:"not null; foreignKey:OwnerID" json:"owner"`
+	User      User                    `gorm:"foreignKey:UserID" json:"user"`
+	Message   MessengerMessage        `gorm:"foreignKey:MessageID" json:"message"`
+	Members   []MessengerDialogMember `gorm:"foreignKey:DialogID" json:"members"`
+}
+
+type MessengerDialogMember struct {
+	gorm.Model
+	DialogID uint   `gorm:"not null; uniqueIndex:idx_messenger_dialog_member" json:"dialog_id"`
+	UserID   int    `gorm:"not null; uniqueIndex:idx_messenger_dialog_member" json:"user_id"`
+	User     User   `gorm:"not null; foreignKey:UserID" json:"user"`
+	Role     string `gorm:"not null" json:"role"`
+	Unread   int    `gorm:"not null; default:0" json:"unread"`
 }
 
 type MessengerMessage struct {
 	gorm.Model
-	FromID   int
-	ToID     int
-	From     User   `gorm:"not null; foreignKey:FromID" json:"from"`
-	To       User   `gorm:"not null; foreignKey:ToID" json:"to"`
-	Type     string `gorm:"not null" json:"type"`
-	Metadata string `gorm:"not null" json:"metadata"`
-	Data     string `gorm:"not null" json:"data"`
-	DialogID uint   `gorm:"not null; default:0" json:"dialog_id"`
-	Read     bool   `gorm:"not null" json:"read"`
+	FromID        int
+	ToID          *int
+	From          User       `gorm:"not null; foreignKey:FromID" json:"from"`
+	To            User       `gorm:"foreignKey:ToID" json:"to"`
+	Type          string     `gorm:"not null" json:"type"`
+	Metadata      string     `gorm:"not null" json:"metadata"`
+	Data          string     `gorm:"not null" json:"data"`
+	DialogID      uint       `gorm:"not null; default:0" json:"dialog_id"`
+	EditedAt      *time.Time `json:"edited_at"`
+	ReplyID       *uint
+	Reply         *MessengerMessage `gorm:"foreignKey:ReplyID" json:"reply"`
+	ForwardFromID *int
+	ForwardFrom   User                `gorm:"foreignKey:ForwardFromID" json:"forward_from"`
+	Receipts      []MessengerReceipt  `gorm:"foreignKey:MessageID" json:"receipts"`
+	Reactions     []MessengerReaction `gorm:"foreignKey:MessageID" json:"reactions"`
+}
+
+type MessengerReaction struct {
+	gorm.Model
+	MessageID uint   `gorm:"not null; uniqueIndex:idx_messenger_reaction" json:"message_id"`
+	UserID    int    `gorm:"not null; uniqueIndex:idx_messenger_reaction" json:"user_id"`
+	Emoji     string `gorm:"not null; uniqueIndex:idx_messenger_reaction" json:"emoji"`
 }
 
+// Previous revision of an edited message
+type MessengerMessageEdit struct {
+	gorm.Model
+	MessageID uint   `gorm:"not null; index" json:"message_id"`
+	Data      string `gorm:"not null" json:"data"`
+}
+
+// Per-user state of a message, silent receipts are read without telling the author
+type MessengerReceipt struct {
+	gorm.Model
+	MessageID   uint       `gorm:"not null; uniqueIndex:idx_messenger_receipt" json:"message_id"`
+	UserID      int        `gorm:"not null; uniqueIndex:idx_messenger_receipt" json:"user_id"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+	Hidden      bool       `gorm:"not null; default:false" json:"hidden"`
+	Silent      bool       `gorm:"not null; default:false" json:"silent"`
+}
+
+// Image content is kept in the blob store under the key, variants scaled down
+// for thumbnails and previews are kept next to it when the image is larger;
+// messages and urls refer to the image by its random uid, the checksum is the
+// SHA-256 of the content the image was made from
 type MessengerImage struct {
 	gorm.Model
-	Data string `gorm:"not null" json:"data"`
+	Uid          string `gorm:"uniqueIndex" json:"-"`
+	Checksum     string `gorm:"not null; default:''; index" json:"-"`
+	Key          string `gorm:"not null; default:''" json:"-"`
+	ThumbnailKey string `gorm:"not null; default:''" json:"-"`
+	PreviewKey   string `gorm:"not null; default:''" json:"-"`
+	MimeType     string `gorm:"not null; default:''" json:"mime_type"`
+	Width        int    `gorm:"not null; default:0" json:"width"`
+	Height       int    `gorm:"not null; default:0" json:"height"`
+}
+
+// Uploaded file, messages of the file type hold its random uid as data
+type MessengerAttachment struct {
+	gorm.Model
+	Uid      string `gorm:"uniqueIndex" json:"-"`
+	UserID   int    `gorm:"not null; index" json:"user_id"`
+	Filename string `gorm:"not null" json:"filename"`
+	MimeType string `gorm:"not null" json:"mime_type"`
+	Size     int64  `gorm:"not null" json:"size"`
+	Checksum string `gorm:"not null" json:"checksum"`
+	Key      string `gorm:"not null; default:''" json:"-"`
+}
+
+// Resumable upload of a file, chunks are kept as blobs until the upload is completed into an attachment
+type MessengerUpload struct {
+	gorm.Model
+	Uid       string                `gorm:"not null; uniqueIndex" json:"-"`
+	UserID    int                   `gorm:"not null; index" json:"user_id"`
+	Filename  string                `gorm:"not null" json:"filename"`
+	Size      int64                 `gorm:"not null" json:"size"`
+	Received  int64                 `gorm:"not null; default:0" json:"received"`
+	ExpiresAt time.Time             `gorm:"not null; index" json:"expires_at"`
+	Parts     []MessengerUploadPart `gorm:"foreignKey:UploadID" json:"parts"`
+}
+
+// Chunk of the upload starting at the offset
+type MessengerUploadPart struct {
+	gorm.Model
+	UploadID uint   `gorm:"not null; uniqueIndex:idx_messenger_upload_part" json:"upload_id"`
+	Offset   int64  `gorm:"not null; uniqueIndex:idx_messenger_upload_part" json:"offset"`
+	Size     int64  `gorm:"not null" json:"size"`
+	Key      string `gorm:"not null" json:"-"`
+}
+
+// Content in the blob store shared by media with the same SHA-256 checksum,
+// the blob is removed by the cleanup once the reference count drops to zero
+type MessengerBlob struct {
+	gorm.Model
+	Checksum string `gorm:"not null; uniqueIndex" json:"checksum"`
+	Key      string `gorm:"not null; uniqueIndex" json:"-"`
+	Size     int64  `gorm:"not null" json:"size"`
+	RefCount int    `gorm:"not null; default:0; index" json:"ref_count"`
 }
@@ -12,4 +12,46 @@ type User struct {
 
 	Otp_enabled bool `gorm:"default:false;"`
 	Otp_secret  string
+
+	// Profile
+	DisplayName string `gorm:"not null; default:''" json:"display_name"`
+	Bio         string `gorm:"not null; default:''" json:"bio"`
+	Avatar      string `gorm:"not null; default:''" json:"-"`
+	Locale      string `gorm:"not null; default:''" json:"locale"`
+	TimeZone    string `gorm:"not null; default:''" json:"time_zone"`
+}
+
+// Who can send direct messages to the user
+const (
+	UserMessageEveryone = "everyone"
+	UserMessageContacts = "contacts"
+	UserMessageNobody   = "nobody"
+)
+
+// Privacy settings of the user
+type UserSettings struct {
+	gorm.Model
+	UserID              int    `gorm:"not null; uniqueIndex" json:"user_id"`
+	HideLastSeen        bool   `gorm:"not null; default:false" json:"hide_last_seen"`
+	HideOnline          bool   `gorm:"not null; default:false" json:"hide_online"`
+	DisableReadReceipts bool   `gorm:"not null; default:false" json:"disable_read_receipts"`
+	WhoCanMessage       string `gorm:"not null; default:everyone" json:"who_can_message"`
+	HideFromSearch      bool   `gorm:"not null; default:false" json:"hide_from_search"`
+}
+
+// User blocked by another user
+type UserBlock struct {
+	gorm.Model
+	UserID    int  `gorm:"not null; uniqueIndex:idx_user_block" json:"user_id"`
+	BlockedID int  `gorm:"not null; uniqueIndex:idx_user_block" json:"blocked_id"`
+	Blocked   User `gorm:"foreignKey:BlockedID" json:"blocked"`
+}
+
+// User in the address book of another user, alias is visible to the owner only
+type UserContact struct {
+	gorm.Model
+	UserID    int    `gorm:"not null; uniqueIndex:idx_user_contact" json:"user_id"`
+	ContactID int    `gorm:"not null; uniqueIndex:idx_user_contact" json:"contact_id"`
+	Contact   User   `gorm:"foreignKey:ContactID" json:"contact"`
+	Alias     string `gorm:"not null; default:''" json:"alias"`
 }
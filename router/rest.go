@@ -1,6 +1,10 @@
 package router
 
 import (
+	"strconv"
+	"time"
+
+	"messenger-service/config"
 	"messenger-service/controller"
 	"messenger-service/middleware"
 
@@ -9,11 +13,23 @@ import (
 )
 
 func Rest(app *fiber.App) {
+	userSearchRate, _ := strconv.Atoi(config.Config("USER_SEARCH_RATE"))
+
 	api := app.Group("/v1", logger.New())
 
 	// Messenger
 	messenger := api.Group("/messenger")
-	messenger.Get("/image/:id", controller.MessengerMessageImage)
+	messenger.Get("/image/:uid", middleware.SignedUrl(), controller.MessengerMessageImage)
+	messenger.Get("/dialog/:id/messages", middleware.JWT(), middleware.OTP(), controller.MessengerDialogMessages)
+	messenger.Post("/attachment", middleware.JWT(), middleware.OTP(), controller.MessengerAttachmentUpload)
+	messenger.Post("/upload", middleware.JWT(), middleware.OTP(), controller.MessengerUploadCreate)
+	messenger.Get("/upload/:uid", middleware.JWT(), middleware.OTP(), controller.MessengerUploadGet)
+	messenger.Patch("/upload/:uid", middleware.JWT(), middleware.OTP(), controller.MessengerUploadChunk)
+	messenger.Post("/upload/:uid/complete", middleware.JWT(), middleware.OTP(), controller.MessengerUploadComplete)
+	messenger.Delete("/upload/:uid", middleware.JWT(), middleware.OTP(), controller.MessengerUploadAbort)
+	messenger.Get("/attachment/:uid", middleware.SignedUrl(), controller.MessengerAttachmentDownload)
+	messenger.Get("/voice/:uid", middleware.SignedUrl(), controller.MessengerMessageVoice)
+	messenger.Get("/search", middleware.JWT(), middleware.OTP(), controller.MessengerSearchMessages)
 
 	// Auth
 	auth := api.Group("/auth")
@@ -28,6 +44,20 @@ func Rest(app *fiber.App) {
 	// User
 	user := api.Group("/user", middleware.JWT(), middleware.OTP())
 	user.Get("/profile", controller.UserProfile)
+	user.Post("/profile", controller.UserProfileUpdate)
+	user.Get("/profile/:id", controller.UserProfilePublic)
+	user.Post("/avatar", controller.UserAvatarUpload)
+	user.Delete("/avatar", controller.UserAvatarRemove)
+	user.Get("/settings", controller.UserSettingsGet)
+	user.Post("/settings", controller.UserSettingsUpdate)
+	user.Get("/blocked", controller.UserBlockedList)
+	user.Post("/block/:id", controller.UserBlockAdd)
+	user.Post("/unblock/:id", controller.UserBlockRemove)
+	user.Get("/search", middleware.RateLimit("user_search", userSearchRate, time.Minute), controller.UserSearch)
+	user.Get("/contacts", controller.UserContactsList)
+	user.Post("/contacts", controller.UserContactAdd)
+	user.Post("/contacts/:id", controller.UserContactUpdate)
+	user.Delete("/contacts/:id", controller.UserContactRemove)
 
 	// Admin
 	// admin := api.Group("/admin", middleware.JWT(), middleware.OTP(), middleware.RBAC())
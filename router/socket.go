@@ -1,9 +1,12 @@
 package router
 
 import (
+	"slices"
 	"strconv"
 	"time"
 
+	"messenger-service/config"
+	"messenger-service/controller"
 	"messenger-service/database"
 	"messenger-service/model"
 	"messenger-service/socketio"
@@ -13,105 +16,56 @@ import (
 )
 
 type InitConnection struct {
-	Dialogs    []MessengerDialog     `json:"dialogs"`
-	UserStatus []MessengerUserStatus `json:"userStatus"`
+	Dialogs    []controller.MessengerDialog     `json:"dialogs"`
+	UserStatus []controller.MessengerUserStatus `json:"userStatus"`
+	Unread     int                              `json:"unread"`
 }
 
-// Messenger
-type MessengerMessage struct {
-	Id       uint          `json:"id"`
-	Created  time.Time     `json:"created"`
-	Dialog   uint          `json:"dialog"`
-	From     MessengerUser `json:"from"`
-	To       MessengerUser `json:"to"`
-	Type     string        `json:"type"`
-	Metadata string        `json:"metadata"`
-	Data     string        `json:"data"`
-	Read     bool          `json:"read"`
-}
-
-type MessengerDialog struct {
-	Id      uint             `json:"id"`
-	Owner   MessengerUser    `json:"owner"`
-	User    MessengerUser    `json:"user"`
-	Message MessengerMessage `json:"message"`
-}
-
-type MessengerUser struct {
-	Id       uint   `json:"id"`
-	Username string `json:"username"`
-}
-
-type MessengerDialogDetails struct {
-	Details  MessengerDialog    `json:"details"`
-	Messages []MessengerMessage `json:"messages"`
-}
-
-type MessengerUserStatus struct {
-	Id     uint `json:"id"`
-	Status bool `json:"status"`
+// Member roles rank, a member can only manage members with a lower rank
+var messengerRoleRank = map[string]int{
+	model.MessengerRoleMember: 0,
+	model.MessengerRoleAdmin:  1,
+	model.MessengerRoleOwner:  2,
 }
 
 func Socket(server *socket.Server) {
 	server.On("connection", func(clients ...interface{}) {
 		client := clients[0].(*socket.Socket)
 
-		client.On("init", func(args ...interface{}) {
-			rooms := server.Sockets().Adapter().Rooms().Keys()
+		var typing *messengerTyping
+		stopPresence := func() {}
+		if client.Data() != nil {
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			typing = newMessengerTyping(owner)
+			stopPresence = messengerPresence(owner, string(client.Id()))
+		}
 
+		client.On("disconnect", func(args ...interface{}) {
+			if typing != nil {
+				typing.stopAll()
+			}
+			stopPresence()
+		})
+
+		client.On("init", func(args ...interface{}) {
 			// UserStatus
 			// Dialogs
-			userStatus := []MessengerUserStatus{}
-			dialogs := []MessengerDialog{}
+			userStatus := []controller.MessengerUserStatus{}
+			dialogs := []controller.MessengerDialog{}
+			unread := 0
 			if client.Data() != nil {
 				// Get [from] user
-				rawDialogs := []model.MessengerDialog{}
 				owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
-				database.Postgres.Where(&model.MessengerDialog{OwnerID: owner}).Preload("Owner").Preload("User").Preload("Message").Preload("Message.From").Preload("Message.To").Find(&rawDialogs)
+				rawDialogs := controller.MessengerDialogList(owner)
+				contacts := controller.UserContactsFind(owner)
 
 				for _, dialog := range rawDialogs {
-					dialogs = append(dialogs, MessengerDialog{
-						Id: dialog.ID,
-						Owner: MessengerUser{
-							Id:       dialog.Owner.ID,
-							Username: dialog.Owner.Username,
-						},
-						User: MessengerUser{
-							Id:       dialog.User.ID,
-							Username: dialog.User.Username,
-						},
-						Message: MessengerMessage{
-							Id:      dialog.Message.ID,
-							Created: dialog.Message.CreatedAt,
-							Dialog:  dialog.ID,
-							From: MessengerUser{
-								Id:       dialog.Message.From.ID,
-								Username: dialog.Message.From.Username,
-							},
-							To: MessengerUser{
-								Id:       dialog.Message.To.ID,
-								Username: dialog.Message.To.Username,
-							},
-							Type:     dialog.Message.Type,
-							Metadata: dialog.Message.Metadata,
-							Data:     dialog.Message.Data,
-							Read:     dialog.Message.Read,
-						},
-					})
-
-					online := false
-					for i := range rooms {
-						if rooms[i] == socket.Room(strconv.FormatUint(uint64(dialog.User.ID), 10)) {
-							online = true
-							break
-						}
-					}
-
-					userStatus = append(userStatus, MessengerUserStatus{
-						Id:     dialog.User.ID,
-						Status: online,
-					})
+					dialogs = append(dialogs, controller.NewMessengerDialog(dialog, owner, contacts))
+					client.Join(socket.Room(controller.MessengerDialogRoom(dialog.ID)))
 				}
+
+				userStatus = controller.MessengerPresence(owner, controller.MessengerPeerIds(owner))
+				unread = controller.MessengerUnreadTotal(owner)
 			}
 
 			// Send response
@@ -120,6 +74,7 @@ func Socket(server *socket.Server) {
 				InitConnection{
 					Dialogs:    dialogs,
 					UserStatus: userStatus,
+					Unread:     unread,
 				},
 			)
 		})
@@ -132,240 +87,371 @@ func Socket(server *socket.Server) {
 				return
 			}
 
-			_type := args[1].(string)
-			data := args[2].(string)
-			_data := ""
+			// Get [to] user
+			if err := database.Postgres.First(new(model.User), to).Error; err != nil {
+				return
+			}
 
-			switch _type {
-			case "text":
-				_data = data
-			case "image":
-				image := new(model.MessengerImage)
-				image.Data = data
-				database.Postgres.Create(&image)
-				_data = strconv.FormatUint(uint64(image.ID), 10)
+			if !controller.MessengerAllowed(from, to) {
+				return
 			}
 
-			// Get [from] user
-			fromUser := new(model.User)
-			database.Postgres.First(&fromUser, from)
+			// Validate the message first so no empty dialog is left behind
+			data, metadata, ok := controller.MessengerMessageData(args[1].(string), args[2].(string), from)
+			if !ok {
+				return
+			}
 
-			// Get [to] user
-			toUser := new(model.User)
-			database.Postgres.First(&toUser, args[0])
-
-			// Create [from] message
-			messageFrom := new(model.MessengerMessage)
-			messageFrom.From = *fromUser
-			messageFrom.To = *toUser
-			messageFrom.Type = _type
-			messageFrom.Metadata = ""
-			messageFrom.Data = _data
-			messageFrom.Read = true
-			database.Postgres.Create(&messageFrom)
-
-			// Create [from] dialog
-			dialogFrom := new(model.MessengerDialog)
-			dialogFrom.Owner = *fromUser
-			dialogFrom.User = *toUser
-			dialogFrom.Message = *messageFrom
-			database.Postgres.Create(&dialogFrom)
-
-			// Update [from] message
-			messageFrom.DialogID = dialogFrom.ID
-			database.Postgres.Save(&messageFrom)
-
-			// Create [to] message
-			messageTo := new(model.MessengerMessage)
-			messageTo.From = *fromUser
-			messageTo.To = *toUser
-			messageTo.Type = _type
-			messageTo.Metadata = ""
-			messageTo.Data = _data
-			messageTo.Read = false
-			database.Postgres.Create(&messageTo)
-
-			// Create [to] dialog
-			dialogTo := new(model.MessengerDialog)
-			dialogTo.Owner = *toUser
-			dialogTo.User = *fromUser
-			dialogTo.Message = *messageTo
-			database.Postgres.Create(&dialogTo)
-
-			// Update [to] message
-			messageTo.DialogID = dialogTo.ID
-			database.Postgres.Save(&messageTo)
+			// Reuse the dialog if users already talk to each other
+			dialog, _, err := controller.MessengerDialogDirectFindOrCreate(from, to)
+			if err != nil {
+				return
+			}
 
-			client.Emit(
+			controller.MessengerSend(dialog, from, model.MessengerMessage{
+				Type:     args[1].(string),
+				Metadata: metadata,
+				Data:     data,
+			})
+
+			dialog, err = controller.MessengerDialogFind(dialog.ID)
+			if err != nil {
+				return
+			}
+
+			controller.MessengerDialogJoin(dialog)
+			controller.MessengerEmitDialog(
+				dialog,
 				"messenger_dialog_create",
-				MessengerDialog{
-					Id: dialogFrom.ID,
-					Owner: MessengerUser{
-						Id:       dialogFrom.Owner.ID,
-						Username: dialogFrom.Owner.Username,
-					},
-					User: MessengerUser{
-						Id:       dialogFrom.User.ID,
-						Username: dialogFrom.User.Username,
-					},
-					Message: MessengerMessage{
-						Id:      dialogFrom.Message.ID,
-						Created: dialogFrom.Message.CreatedAt,
-						Dialog:  dialogFrom.ID,
-						From: MessengerUser{
-							Id:       dialogFrom.Message.From.ID,
-							Username: dialogFrom.Message.From.Username,
-						},
-						To: MessengerUser{
-							Id:       dialogFrom.Message.To.ID,
-							Username: dialogFrom.Message.To.Username,
-						},
-						Type:     dialogFrom.Message.Type,
-						Metadata: dialogFrom.Message.Metadata,
-						Data:     dialogFrom.Message.Data,
-						Read:     dialogFrom.Message.Read,
-					},
+			)
+		})
+
+		client.On("messenger_group_create", func(args ...interface{}) {
+			if len(args) < 2 {
+				return
+			}
+
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			title, ok := args[0].(string)
+			if !ok || title == "" {
+				return
+			}
+
+			// Get [members] users
+			users := []model.User{}
+			database.Postgres.Where("id IN ?", parseIds(args[1])).Find(&users)
+
+			// Create group dialog
+			dialog := new(model.MessengerDialog)
+			dialog.Type = model.MessengerDialogGroup
+			dialog.Title = title
+			dialog.OwnerID = owner
+			dialog.Members = []model.MessengerDialogMember{
+				{
+					UserID: owner,
+					Role:   model.MessengerRoleOwner,
 				},
+			}
+			for _, user := range users {
+				if int(user.ID) == owner || !controller.MessengerAllowed(owner, int(user.ID)) {
+					continue
+				}
+
+				dialog.Members = append(dialog.Members, model.MessengerDialogMember{
+					UserID: int(user.ID),
+					Role:   model.MessengerRoleMember,
+				})
+			}
+			database.Postgres.Create(&dialog)
+
+			rawDialog, err := controller.MessengerDialogFind(dialog.ID)
+			if err != nil {
+				return
+			}
+
+			controller.MessengerDialogJoin(rawDialog)
+			controller.MessengerEmitDialog(
+				rawDialog,
+				"messenger_dialog_create",
 			)
+		})
+
+		client.On("messenger_group_add", func(args ...interface{}) {
+			if len(args) < 2 {
+				return
+			}
+
+			dialogId, _ := parseId(args[0])
+			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			user, ok := parseId(args[1])
+			if !ok {
+				return
+			}
+
+			dialog, err := controller.MessengerDialogFind(uint(dialogId))
+			if err != nil || dialog.Type != model.MessengerDialogGroup {
+				return
+			}
+
+			// Only owner and admins can add members
+			member, ok := controller.MessengerDialogMemberFind(dialog, from)
+			if !ok || messengerRoleRank[member.Role] < messengerRoleRank[model.MessengerRoleAdmin] {
+				return
+			}
+
+			if _, ok := controller.MessengerDialogMemberFind(dialog, user); ok {
+				return
+			}
+
+			if err := database.Postgres.First(new(model.User), user).Error; err != nil {
+				return
+			}
+
+			if !controller.MessengerAllowed(from, user) {
+				return
+			}
 
+			database.Postgres.Create(&model.MessengerDialogMember{
+				DialogID: dialog.ID,
+				UserID:   user,
+				Role:     model.MessengerRoleMember,
+			})
+
+			dialog, err = controller.MessengerDialogFind(dialog.ID)
+			if err != nil {
+				return
+			}
+
+			socketio.Join(strconv.Itoa(user), controller.MessengerDialogRoom(dialog.ID))
 			socketio.Emit(
-				args[0].(string),
+				strconv.Itoa(user),
 				"messenger_dialog_create",
-				MessengerDialog{
-					Id: dialogTo.ID,
-					Owner: MessengerUser{
-						Id:       dialogTo.Owner.ID,
-						Username: dialogTo.Owner.Username,
-					},
-					User: MessengerUser{
-						Id:       dialogTo.User.ID,
-						Username: dialogTo.User.Username,
-					},
-					Message: MessengerMessage{
-						Id:      dialogTo.Message.ID,
-						Created: dialogTo.Message.CreatedAt,
-						Dialog:  dialogTo.ID,
-						From: MessengerUser{
-							Id:       dialogTo.Message.From.ID,
-							Username: dialogTo.Message.From.Username,
-						},
-						To: MessengerUser{
-							Id:       dialogTo.Message.To.ID,
-							Username: dialogTo.Message.To.Username,
-						},
-						Type:     dialogTo.Message.Type,
-						Metadata: dialogTo.Message.Metadata,
-						Data:     dialogTo.Message.Data,
-						Read:     dialogTo.Message.Read,
-					},
-				},
+				controller.NewMessengerDialog(dialog, user, controller.UserContactsFind(user)),
+			)
+
+			controller.MessengerEmitDialog(
+				dialog,
+				"messenger_group_update",
+				user,
+			)
+		})
+
+		client.On("messenger_group_remove", func(args ...interface{}) {
+			if len(args) < 2 {
+				return
+			}
+
+			dialogId, _ := parseId(args[0])
+			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			user, ok := parseId(args[1])
+			if !ok || from == user {
+				return
+			}
+
+			dialog, err := controller.MessengerDialogFind(uint(dialogId))
+			if err != nil || dialog.Type != model.MessengerDialogGroup {
+				return
+			}
+
+			member, ok := controller.MessengerDialogMemberFind(dialog, from)
+			if !ok {
+				return
+			}
+
+			target, ok := controller.MessengerDialogMemberFind(dialog, user)
+			if !ok || messengerRoleRank[member.Role] <= messengerRoleRank[target.Role] {
+				return
+			}
+
+			database.Postgres.Unscoped().Delete(&target)
+			controller.MessengerUnreadPush(dialog.ID, user)
+
+			dialog, err = controller.MessengerDialogFind(dialog.ID)
+			if err != nil {
+				return
+			}
+
+			socketio.Leave(strconv.Itoa(user), controller.MessengerDialogRoom(dialog.ID))
+			socketio.Emit(
+				strconv.Itoa(user),
+				"messenger_group_remove",
+				controller.NewMessengerDialog(dialog, user, controller.UserContactsFind(user)),
+			)
+
+			controller.MessengerEmitDialog(
+				dialog,
+				"messenger_group_update",
+			)
+		})
+
+		client.On("messenger_group_leave", func(args ...interface{}) {
+			if len(args) < 1 {
+				return
+			}
+
+			dialogId, _ := parseId(args[0])
+			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+
+			dialog, err := controller.MessengerDialogFind(uint(dialogId))
+			if err != nil || dialog.Type != model.MessengerDialogGroup {
+				return
+			}
+
+			member, ok := controller.MessengerDialogMemberFind(dialog, from)
+			if !ok {
+				return
+			}
+
+			database.Postgres.Unscoped().Delete(&member)
+			controller.MessengerUnreadPush(dialog.ID, from)
+
+			// Pass ownership to the oldest admin or, if there is none, to the oldest member
+			if member.Role == model.MessengerRoleOwner {
+				var successor *model.MessengerDialogMember
+				for i := range dialog.Members {
+					candidate := &dialog.Members[i]
+					if candidate.UserID == from {
+						continue
+					}
+
+					if successor == nil || messengerRoleRank[candidate.Role] > messengerRoleRank[successor.Role] {
+						successor = candidate
+					}
+				}
+
+				// Nobody left in the group
+				if successor == nil {
+					database.Postgres.Delete(&dialog)
+				} else {
+					database.Postgres.Model(&model.MessengerDialogMember{}).Where("id = ?", successor.ID).Update("role", model.MessengerRoleOwner)
+					database.Postgres.Model(&model.MessengerDialog{}).Where("id = ?", dialog.ID).Update("owner_id", successor.UserID)
+				}
+			}
+
+			typing.stop(dialog.ID)
+			socketio.Leave(strconv.Itoa(from), controller.MessengerDialogRoom(dialog.ID))
+			socketio.Emit(
+				strconv.Itoa(from),
+				"messenger_group_remove",
+				controller.NewMessengerDialog(dialog, from, controller.UserContactsFind(from)),
+			)
+
+			dialog, err = controller.MessengerDialogFind(dialog.ID)
+			if err != nil {
+				return
+			}
+
+			controller.MessengerEmitDialog(
+				dialog,
+				"messenger_group_update",
+			)
+		})
+
+		client.On("messenger_group_role", func(args ...interface{}) {
+			if len(args) < 3 {
+				return
+			}
+
+			dialogId, _ := parseId(args[0])
+			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			user, ok := parseId(args[1])
+			if !ok || from == user {
+				return
+			}
+
+			role, _ := args[2].(string)
+			if _, ok := messengerRoleRank[role]; !ok {
+				return
+			}
+
+			dialog, err := controller.MessengerDialogFind(uint(dialogId))
+			if err != nil || dialog.Type != model.MessengerDialogGroup {
+				return
+			}
+
+			// Only owner can change roles
+			member, ok := controller.MessengerDialogMemberFind(dialog, from)
+			if !ok || member.Role != model.MessengerRoleOwner {
+				return
+			}
+
+			target, ok := controller.MessengerDialogMemberFind(dialog, user)
+			if !ok {
+				return
+			}
+
+			database.Postgres.Model(&model.MessengerDialogMember{}).Where("id = ?", target.ID).Update("role", role)
+
+			// Transfer ownership
+			if role == model.MessengerRoleOwner {
+				database.Postgres.Model(&model.MessengerDialogMember{}).Where("id = ?", member.ID).Update("role", model.MessengerRoleAdmin)
+				database.Postgres.Model(&model.MessengerDialog{}).Where("id = ?", dialog.ID).Update("owner_id", user)
+			}
+
+			dialog, err = controller.MessengerDialogFind(dialog.ID)
+			if err != nil {
+				return
+			}
+
+			controller.MessengerEmitDialog(
+				dialog,
+				"messenger_group_update",
 			)
 		})
 
 		client.On("messenger_dialog_messages", func(args ...interface{}) {
 			dialog, _ := strconv.ParseUint(args[0].(string), 10, 64)
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
 
-			messages := []MessengerMessage{}
-			rawMessages := []model.MessengerMessage{}
-			database.Postgres.Order("ID asc").Where(&model.MessengerMessage{DialogID: uint(dialog)}).Preload("From").Preload("To").Find(&rawMessages)
+			// Get [from] dialog
+			fromDialog, err := controller.MessengerDialogFind(uint(dialog))
+			if err != nil {
+				return
+			}
 
-			for _, message := range rawMessages {
-				messages = append(messages, MessengerMessage{
-					Id:      message.ID,
-					Created: message.CreatedAt,
-					Dialog:  message.DialogID,
-					From: MessengerUser{
-						Id:       message.From.ID,
-						Username: message.From.Username,
-					},
-					To: MessengerUser{
-						Id:       message.To.ID,
-						Username: message.To.Username,
-					},
-					Type:     message.Type,
-					Metadata: message.Metadata,
-					Data:     message.Data,
-					Read:     message.Read,
-				})
+			if _, ok := controller.MessengerDialogMemberFind(fromDialog, owner); !ok {
+				return
 			}
 
-			database.Postgres.Model(&model.MessengerMessage{}).Where(&model.MessengerMessage{DialogID: uint(dialog)}).Update("read", true)
+			// Optional cursor: { before, after, limit }
+			cursor := controller.MessengerHistoryCursor{}
+			if len(args) > 1 {
+				if options, ok := args[1].(map[string]interface{}); ok {
+					cursor.Before, _ = parseId(options["before"])
+					cursor.After, _ = parseId(options["after"])
+					cursor.Limit, _ = parseId(options["limit"])
+				}
+			}
 
-			// Get [from] dialog
-			fromDialog := model.MessengerDialog{}
-			database.Postgres.Preload("Owner").Preload("User").Preload("Message").Find(&fromDialog, dialog)
+			messages := []controller.MessengerMessage{}
+			rawMessages, hasMore := controller.MessengerHistory(uint(dialog), owner, cursor)
+
+			for _, message := range rawMessages {
+				messages = append(messages, controller.NewMessengerMessage(message, owner))
+			}
+
+			// Older pages hold nothing new, others are read up to the newest message shown
+			if cursor.Before <= 0 && len(rawMessages) > 0 {
+				controller.MessengerDialogRead(uint(dialog), owner, rawMessages[len(rawMessages)-1].ID)
+			}
 
 			client.Emit(
 				"messenger_dialog_messages",
-				MessengerDialogDetails{
-					Details: MessengerDialog{
-						Id: fromDialog.ID,
-						Owner: MessengerUser{
-							Id:       fromDialog.Owner.ID,
-							Username: fromDialog.Owner.Username,
-						},
-						User: MessengerUser{
-							Id:       fromDialog.User.ID,
-							Username: fromDialog.User.Username,
-						},
-						Message: MessengerMessage{
-							Id:      fromDialog.Message.ID,
-							Created: fromDialog.Message.CreatedAt,
-							Dialog:  fromDialog.ID,
-							From: MessengerUser{
-								Id:       fromDialog.Message.From.ID,
-								Username: fromDialog.Message.From.Username,
-							},
-							To: MessengerUser{
-								Id:       fromDialog.Message.To.ID,
-								Username: fromDialog.Message.To.Username,
-							},
-							Type:     fromDialog.Message.Type,
-							Metadata: fromDialog.Message.Metadata,
-							Data:     fromDialog.Message.Data,
-							Read:     fromDialog.Message.Read,
-						},
-					},
+				controller.MessengerDialogDetails{
+					Details:  controller.NewMessengerDialog(fromDialog, owner, controller.UserContactsFind(owner)),
 					Messages: messages,
+					HasMore:  hasMore,
 				},
 			)
 		})
 
 		client.On("messenger_dialog_list", func(args ...interface{}) {
-			dialogs := []MessengerDialog{}
-			rawDialogs := []model.MessengerDialog{}
+			dialogs := []controller.MessengerDialog{}
 			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
-			database.Postgres.Where(&model.MessengerDialog{OwnerID: owner}).Preload("Owner").Preload("User").Preload("Message").Preload("Message.From").Preload("Message.To").Find(&rawDialogs)
-
-			for _, dialog := range rawDialogs {
-				dialogs = append(dialogs, MessengerDialog{
-					Id: dialog.ID,
-					Owner: MessengerUser{
-						Id:       dialog.Owner.ID,
-						Username: dialog.Owner.Username,
-					},
-					User: MessengerUser{
-						Id:       dialog.User.ID,
-						Username: dialog.User.Username,
-					},
-					Message: MessengerMessage{
-						Id:      dialog.Message.ID,
-						Created: dialog.Message.CreatedAt,
-						Dialog:  dialog.ID,
-						From: MessengerUser{
-							Id:       dialog.Message.From.ID,
-							Username: dialog.Message.From.Username,
-						},
-						To: MessengerUser{
-							Id:       dialog.Message.To.ID,
-							Username: dialog.Message.To.Username,
-						},
-						Type:     dialog.Message.Type,
-						Metadata: dialog.Message.Metadata,
-						Data:     dialog.Message.Data,
-						Read:     dialog.Message.Read,
-					},
-				})
+
+			contacts := controller.UserContactsFind(owner)
+			for _, dialog := range controller.MessengerDialogList(owner) {
+				dialogs = append(dialogs, controller.NewMessengerDialog(dialog, owner, contacts))
 			}
 
 			client.Emit(
@@ -374,142 +460,464 @@ func Socket(server *socket.Server) {
 			)
 		})
 
+		client.On("messenger_search", func(args ...interface{}) {
+			if len(args) < 1 {
+				return
+			}
+			options, ok := args[0].(map[string]interface{})
+			if !ok {
+				return
+			}
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+
+			// Options: { query, dialog, from, since, until, type, before, limit }
+			filter := controller.MessengerSearchFilter{}
+			filter.Query, _ = options["query"].(string)
+			filter.Type, _ = options["type"].(string)
+			dialog, _ := parseId(options["dialog"])
+			filter.Dialog = uint(max(dialog, 0))
+			filter.From, _ = parseId(options["from"])
+			since, _ := parseId(options["since"])
+			filter.Since = int64(since)
+			until, _ := parseId(options["until"])
+			filter.Until = int64(until)
+			before, _ := parseId(options["before"])
+			filter.Before = uint(max(before, 0))
+			filter.Limit, _ = parseId(options["limit"])
+
+			results, ok := controller.MessengerSearch(owner, filter)
+			if !ok {
+				return
+			}
+
+			client.Emit(
+				"messenger_search",
+				results,
+			)
+		})
+
 		client.On("messenger_send_message", func(args ...interface{}) {
 			dialog, _ := strconv.ParseUint(args[0].(string), 10, 64)
 			_type := args[1].(string)
 			data := args[2].(string)
 			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
 
-			_data := ""
+			// Get [from] dialog
+			fromDialog, err := controller.MessengerDialogFind(uint(dialog))
+			if err != nil {
+				return
+			}
 
-			switch _type {
-			case "text":
-				_data = data
-			case "image":
-				image := new(model.MessengerImage)
-				image.Data = data
-				database.Postgres.Create(&image)
-				_data = strconv.FormatUint(uint64(image.ID), 10)
+			if _, ok := controller.MessengerDialogMemberFind(fromDialog, from); !ok {
+				return
 			}
 
-			// Get [from] dialog
-			fromDialog := model.MessengerDialog{}
-			database.Postgres.Where(&model.MessengerDialog{OwnerID: from}).Preload("Owner").Preload("User").Preload("Message").Find(&fromDialog, dialog)
+			if !controller.MessengerDialogAllowed(fromDialog, from) {
+				return
+			}
 
-			// Get [to] dialog
-			toDialog := model.MessengerDialog{}
-			database.Postgres.Where(&model.MessengerDialog{OwnerID: fromDialog.UserID, UserID: from}).Preload("Owner").Preload("User").Preload("Message").Find(&toDialog)
+			content := model.MessengerMessage{
+				Type: _type,
+			}
 
-			// Get [from] user
-			fromUser := new(model.User)
-			database.Postgres.First(&fromUser, from)
+			// Optional quoted message from the same dialog
+			if len(args) > 3 {
+				if id, ok := parseId(args[3]); ok {
+					reply, err := controller.MessengerMessageFind(uint(id))
+					if err != nil || reply.DialogID != fromDialog.ID {
+						return
+					}
 
-			// Get [to] user
-			toUser := new(model.User)
-			database.Postgres.First(&toUser, fromDialog.UserID)
-
-			// Create [from] message
-			messageFrom := new(model.MessengerMessage)
-			messageFrom.DialogID = fromDialog.ID
-			messageFrom.From = *fromUser
-			messageFrom.To = *toUser
-			messageFrom.Type = _type
-			messageFrom.Metadata = ""
-			messageFrom.Data = _data
-			messageFrom.Read = true
-			database.Postgres.Create(&messageFrom)
-
-			// Update [from] dialog
-			fromDialog.Message = *messageFrom
-			database.Postgres.Save(&fromDialog)
-
-			// Create [to] message
-			messageTo := new(model.MessengerMessage)
-			messageTo.DialogID = toDialog.ID
-			messageTo.From = *fromUser
-			messageTo.To = *toUser
-			messageTo.Type = _type
-			messageTo.Metadata = ""
-			messageTo.Data = _data
-			messageTo.Read = false
-			database.Postgres.Create(&messageTo)
-
-			// Update [to] dialog
-			toDialog.Message = *messageTo
-			database.Postgres.Save(&toDialog)
+					content.ReplyID = &reply.ID
+					content.Reply = &reply
+				}
+			}
 
-			client.Emit(
+			data, metadata, ok := controller.MessengerMessageData(_type, data, from)
+			if !ok {
+				return
+			}
+			content.Data = data
+			content.Metadata = metadata
+
+			typing.stop(fromDialog.ID)
+
+			message := controller.MessengerSend(fromDialog, from, content)
+
+			controller.MessengerEmitMessage(
+				fromDialog,
+				message,
 				"messenger_send_message",
-				MessengerMessage{
-					Id:      messageFrom.ID,
-					Created: messageFrom.CreatedAt,
-					Dialog:  messageFrom.DialogID,
-					From: MessengerUser{
-						Id:       messageFrom.From.ID,
-						Username: messageFrom.From.Username,
-					},
-					To: MessengerUser{
-						Id:       messageFrom.To.ID,
-						Username: messageFrom.To.Username,
-					},
-					Type:     messageFrom.Type,
-					Metadata: messageFrom.Metadata,
-					Data:     messageFrom.Data,
-					Read:     messageFrom.Read,
-				},
 			)
+		})
 
-			socketio.Emit(
-				strconv.Itoa(fromDialog.UserID),
-				"messenger_send_message",
-				MessengerMessage{
-					Id:      messageTo.ID,
-					Created: messageTo.CreatedAt,
-					Dialog:  messageTo.DialogID,
-					From: MessengerUser{
-						Id:       messageTo.From.ID,
-						Username: messageTo.From.Username,
+		client.On("messenger_forward_message", func(args ...interface{}) {
+			if len(args) < 3 {
+				return
+			}
+
+			ids := parseIds(args[0])
+			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+
+			slices.Sort(ids)
+			ids = slices.Compact(ids)
+			if len(ids) == 0 || len(ids) > controller.MessengerForwardLimit {
+				return
+			}
+
+			// Forward to the dialog or, if it is not set, to the user
+			var toDialog model.MessengerDialog
+			var err error
+			created := false
+			if dialog, ok := parseId(args[1]); ok && dialog > 0 {
+				toDialog, err = controller.MessengerDialogFind(uint(dialog))
+			} else {
+				to, _ := parseId(args[2])
+				if to == from {
+					return
+				}
+
+				if err := database.Postgres.First(new(model.User), to).Error; err != nil {
+					return
+				}
+
+				if !controller.MessengerAllowed(from, to) {
+					return
+				}
+
+				toDialog, created, err = controller.MessengerDialogDirectFindOrCreate(from, to)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, ok := controller.MessengerDialogMemberFind(toDialog, from); !ok {
+				return
+			}
+
+			if !controller.MessengerDialogAllowed(toDialog, from) {
+				return
+			}
+
+			// Only messages visible to the forwarder in dialogs the forwarder is a member of
+			sources := []model.MessengerMessage{}
+			database.Postgres.
+				Where("id IN ?", ids).
+				Where("type <> ?", "deleted").
+				Where("id NOT IN (?)", controller.MessengerHidden(from)).
+				Where(
+					"dialog_id IN (?)",
+					database.Postgres.Model(&model.MessengerDialogMember{}).Select("dialog_id").Where(&model.MessengerDialogMember{UserID: from}),
+				).
+				Order("id asc").
+				Find(&sources)
+
+			if len(sources) != len(ids) {
+				return
+			}
+
+			for _, source := range sources {
+				// Keep the original author when forwarding forwarded message
+				author := source.FromID
+				if source.ForwardFromID != nil {
+					author = *source.ForwardFromID
+				}
+
+				content := model.MessengerMessage{
+					Type:          source.Type,
+					Metadata:      source.Metadata,
+					Data:          source.Data,
+					ForwardFromID: &author,
+				}
+				database.Postgres.First(&content.ForwardFrom, author)
+
+				message := controller.MessengerSend(toDialog, from, content)
+
+				controller.MessengerEmitMessage(
+					toDialog,
+					message,
+					"messenger_send_message",
+				)
+			}
+
+			if created {
+				toDialog, err = controller.MessengerDialogFind(toDialog.ID)
+				if err != nil {
+					return
+				}
+
+				controller.MessengerDialogJoin(toDialog)
+				controller.MessengerEmitDialog(
+					toDialog,
+					"messenger_dialog_create",
+				)
+			}
+		})
+
+		client.On("messenger_edit_message", func(args ...interface{}) {
+			if len(args) < 2 {
+				return
+			}
+
+			id, _ := parseId(args[0])
+			data, _ := args[1].(string)
+			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+
+			// Only author can edit own text messages, forwarded copies keep the words of the original author
+			message, err := controller.MessengerMessageFind(uint(id))
+			if err != nil || message.FromID != from || message.Type != "text" || message.ForwardFromID != nil {
+				return
+			}
+
+			if data == "" || data == message.Data {
+				return
+			}
+
+			minutesCount, _ := strconv.Atoi(config.Config("MESSENGER_EDIT_WINDOW"))
+			if minutesCount > 0 && time.Since(message.CreatedAt) > time.Minute*time.Duration(minutesCount) {
+				return
+			}
+
+			dialog, err := controller.MessengerDialogFind(message.DialogID)
+			if err != nil {
+				return
+			}
+
+			if _, ok := controller.MessengerDialogMemberFind(dialog, from); !ok {
+				return
+			}
+
+			// Keep previous revision
+			database.Postgres.Create(&model.MessengerMessageEdit{
+				MessageID: message.ID,
+				Data:      message.Data,
+			})
+
+			now := time.Now()
+			database.Postgres.Model(&model.MessengerMessage{}).Where("id = ?", message.ID).Updates(map[string]interface{}{
+				"data":      data,
+				"edited_at": now,
+			})
+			message.Data = data
+			message.EditedAt = &now
+
+			controller.MessengerEmitMessage(
+				dialog,
+				message,
+				"messenger_edit_message",
+			)
+		})
+
+		client.On("messenger_delete_message", func(args ...interface{}) {
+			if len(args) < 2 {
+				return
+			}
+
+			id, _ := parseId(args[0])
+			mode, _ := args[1].(string)
+			everyone := mode == "everyone"
+			from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+
+			message, err := controller.MessengerMessageFind(uint(id))
+			if err != nil {
+				return
+			}
+
+			dialog, err := controller.MessengerDialogFind(message.DialogID)
+			if err != nil {
+				return
+			}
+
+			if _, ok := controller.MessengerDialogMemberFind(dialog, from); !ok {
+				return
+			}
+
+			// Delete for me, hide message for the caller only
+			if !everyone {
+				receipt := model.MessengerReceipt{}
+				database.Postgres.
+					Where(&model.MessengerReceipt{MessageID: message.ID, UserID: from}).
+					Assign(model.MessengerReceipt{Hidden: true}).
+					FirstOrCreate(&receipt)
+				controller.MessengerUnreadCount(dialog.ID, from)
+
+				dialog, err = controller.MessengerDialogFind(dialog.ID)
+				if err != nil {
+					return
+				}
+
+				details := controller.NewMessengerDialog(dialog, from, controller.UserContactsFind(from))
+				details.Message = controller.NewMessengerMessage(controller.MessengerDialogLast(dialog.ID, from), from)
+
+				socketio.Emit(
+					strconv.Itoa(from),
+					"messenger_delete_message",
+					controller.MessengerMessageDelete{
+						Id:       message.ID,
+						Everyone: false,
+						Dialog:   details,
 					},
-					To: MessengerUser{
-						Id:       messageTo.To.ID,
-						Username: messageTo.To.Username,
+				)
+				return
+			}
+
+			// Delete for everyone, only author can leave a tombstone
+			if message.FromID != from || message.Type == "deleted" {
+				return
+			}
+
+			minutesCount, _ := strconv.Atoi(config.Config("MESSENGER_DELETE_WINDOW"))
+			if minutesCount > 0 && time.Since(message.CreatedAt) > time.Minute*time.Duration(minutesCount) {
+				return
+			}
+
+			database.Postgres.Model(&model.MessengerMessage{}).Where("id = ?", message.ID).Updates(map[string]interface{}{
+				"type":     "deleted",
+				"metadata": "",
+				"data":     "",
+			})
+			database.Postgres.Unscoped().Where(&model.MessengerMessageEdit{MessageID: message.ID}).Delete(&model.MessengerMessageEdit{})
+			database.Postgres.Unscoped().Where(&model.MessengerReaction{MessageID: message.ID}).Delete(&model.MessengerReaction{})
+
+			if message.Type == "image" {
+				controller.MessengerImageRelease(message.Data)
+			}
+			if message.Type == "file" || message.Type == "voice" {
+				controller.MessengerAttachmentRelease(message.Data)
+			}
+
+			if dialog.MessageID != nil && *dialog.MessageID == message.ID {
+				controller.MessengerDialogRefresh(dialog.ID)
+			}
+
+			for _, member := range dialog.Members {
+				if member.UserID != from {
+					controller.MessengerUnreadCount(dialog.ID, member.UserID)
+				}
+			}
+
+			dialog, err = controller.MessengerDialogFind(dialog.ID)
+			if err != nil {
+				return
+			}
+
+			users := []int{}
+			for _, member := range dialog.Members {
+				users = append(users, member.UserID)
+			}
+			contacts := controller.UserContactsFindMany(users)
+			for _, member := range dialog.Members {
+				socketio.Emit(
+					strconv.Itoa(member.UserID),
+					"messenger_delete_message",
+					controller.MessengerMessageDelete{
+						Id:       message.ID,
+						Everyone: true,
+						Dialog:   controller.NewMessengerDialog(dialog, member.UserID, contacts[member.UserID]),
 					},
-					Type:     messageTo.Type,
-					Metadata: messageTo.Metadata,
-					Data:     messageTo.Data,
-					Read:     messageTo.Read,
-				},
-			)
+				)
+			}
+		})
+
+		client.On("messenger_reaction_add", func(args ...interface{}) {
+			messengerReaction(client, args, true)
+		})
+
+		client.On("messenger_reaction_remove", func(args ...interface{}) {
+			messengerReaction(client, args, false)
 		})
 
 		client.On("messenger_read_dialog", func(args ...interface{}) {
 			dialog, _ := strconv.ParseUint(args[0].(string), 10, 64)
-			database.Postgres.Model(&model.MessengerMessage{}).Where(&model.MessengerMessage{DialogID: uint(dialog)}).Update("read", true)
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+
+			// Optional watermark, messages after it stay unread
+			until := 0
+			if len(args) > 1 {
+				until, _ = parseId(args[1])
+			}
+
+			controller.MessengerDialogRead(uint(dialog), owner, uint(until))
 		})
 
-		client.On("messenger_user_status", func(args ...interface{}) {
-			rooms := server.Sockets().Adapter().Rooms().Keys()
+		client.On("messenger_delivered_dialog", func(args ...interface{}) {
+			if len(args) < 1 {
+				return
+			}
 
-			userStatus := []MessengerUserStatus{}
-			if client.Data() != nil {
-				rawDialogs := []model.MessengerDialog{}
-				owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
-				database.Postgres.Where(&model.MessengerDialog{OwnerID: owner}).Preload("Owner").Preload("User").Preload("Message").Find(&rawDialogs)
+			dialog, _ := parseId(args[0])
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
 
-				for _, dialog := range rawDialogs {
-					online := false
-					for i := range rooms {
-						if rooms[i] == socket.Room(strconv.FormatUint(uint64(dialog.User.ID), 10)) {
-							online = true
-							break
-						}
-					}
+			// Optional watermark, messages after it stay undelivered
+			until := 0
+			if len(args) > 1 {
+				until, _ = parseId(args[1])
+			}
 
-					userStatus = append(userStatus, MessengerUserStatus{
-						Id:     dialog.User.ID,
-						Status: online,
-					})
-				}
+			controller.MessengerDialogDelivered(uint(dialog), owner, uint(until))
+		})
+
+		client.On("typing_start", func(args ...interface{}) {
+			if len(args) < 1 {
+				return
+			}
+
+			dialog, ok := parseId(args[0])
+			if typing == nil || !ok {
+				return
+			}
+
+			typing.start(client, uint(dialog))
+		})
+
+		client.On("typing_stop", func(args ...interface{}) {
+			if len(args) < 1 {
+				return
+			}
+
+			dialog, ok := parseId(args[0])
+			if typing == nil || !ok {
+				return
+			}
+
+			typing.stop(uint(dialog))
+		})
+
+		client.On("user_block", func(args ...interface{}) {
+			if len(args) < 1 {
+				return
+			}
+
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			if user, ok := parseId(args[0]); ok {
+				controller.UserBlock(owner, user)
+			}
+		})
+
+		client.On("user_unblock", func(args ...interface{}) {
+			if len(args) < 1 {
+				return
+			}
+
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			if user, ok := parseId(args[0]); ok {
+				controller.UserUnblock(owner, user)
+			}
+		})
+
+		client.On("user_blocked", func(args ...interface{}) {
+			owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+			client.Emit(
+				"user_blocked",
+				controller.UserBlockedFind(owner),
+			)
+		})
+
+		client.On("messenger_user_status", func(args ...interface{}) {
+			userStatus := []controller.MessengerUserStatus{}
+			if client.Data() != nil {
+				owner, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+				userStatus = controller.MessengerPresence(owner, controller.MessengerPeerIds(owner))
 			}
 
 			// Send response
@@ -520,3 +928,108 @@ func Socket(server *socket.Server) {
 		})
 	})
 }
+
+// Add or remove reaction of the client to the message and push reactions to members,
+// arguments are the message id and the emoji
+func messengerReaction(client *socket.Socket, args []interface{}, add bool) {
+	if len(args) < 2 {
+		return
+	}
+
+	messageId, _ := parseId(args[0])
+	from, _ := strconv.Atoi(client.Data().(*utils.TokenMetadata).Id)
+
+	emoji, ok := args[1].(string)
+	if !ok || !controller.MessengerReactionValid(emoji) {
+		return
+	}
+
+	message, err := controller.MessengerMessageFind(uint(messageId))
+	if err != nil || message.Type == "deleted" {
+		return
+	}
+
+	dialog, err := controller.MessengerDialogFind(message.DialogID)
+	if err != nil {
+		return
+	}
+
+	if _, ok := controller.MessengerDialogMemberFind(dialog, from); !ok {
+		return
+	}
+
+	reaction := model.MessengerReaction{
+		MessageID: message.ID,
+		UserID:    from,
+		Emoji:     emoji,
+	}
+	if add {
+		database.Postgres.Where(&reaction).FirstOrCreate(&reaction)
+	} else {
+		database.Postgres.Unscoped().Where(&reaction).Delete(&model.MessengerReaction{})
+	}
+
+	reactions := []model.MessengerReaction{}
+	database.Postgres.Where(&model.MessengerReaction{MessageID: message.ID}).Order("id asc").Find(&reactions)
+
+	for _, member := range dialog.Members {
+		socketio.Emit(
+			strconv.Itoa(member.UserID),
+			"reaction_updated",
+			controller.MessengerReactionUpdate{
+				Id:        message.ID,
+				Dialog:    dialog.ID,
+				Reactions: controller.NewMessengerReactions(reactions, member.UserID),
+			},
+		)
+	}
+}
+
+// Keep presence of the connection alive until the returned function is called on disconnect
+func messengerPresence(user int, connection string) func() {
+	controller.MessengerPresenceHeartbeat(user, connection)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(controller.MessengerPresenceInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				controller.MessengerPresenceHeartbeat(user, connection)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		controller.MessengerPresenceLeave(user, connection)
+	}
+}
+
+// Parse id sent as string or number
+func parseId(value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case string:
+		id, err := strconv.Atoi(value)
+		return id, err == nil
+	case float64:
+		return int(value), true
+	}
+	return 0, false
+}
+
+// Parse list of ids sent as strings or numbers
+func parseIds(arg interface{}) []int {
+	ids := []int{}
+	values, _ := arg.([]interface{})
+	for _, value := range values {
+		if id, ok := parseId(value); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,119 @@
+package router
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"messenger-service/controller"
+	"messenger-service/socketio"
+
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+// Typing indicator expires if the client does not repeat typing_start in time
+const messengerTypingTimeout = 6 * time.Second
+
+// Typing indicators of one connection, relayed to dialog rooms without touching Postgres
+// for membership; block relations come from the Redis cache and are loaded from Postgres
+// on a miss, once per cache lifetime, as treating a miss as no blocks would leak typing
+// to blocked users
+type messengerTyping struct {
+	mutex  sync.Mutex
+	user   int
+	timers map[uint]*time.Timer
+}
+
+func newMessengerTyping(user int) *messengerTyping {
+	return &messengerTyping{
+		user:   user,
+		timers: map[uint]*time.Timer{},
+	}
+}
+
+// Notify other members of the dialog, or extend the indicator if it is already shown
+func (t *messengerTyping) start(client *socket.Socket, dialog uint) {
+	// Connection joins rooms of its dialogs, so no database lookup is needed
+	if !client.Rooms().Has(socket.Room(controller.MessengerDialogRoom(dialog))) {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	shown, ok := t.timers[dialog]
+	if ok && shown.Stop() {
+		shown.Reset(messengerTypingTimeout)
+		return
+	}
+
+	// Timer is read by the callback only after it takes the lock
+	var timer *time.Timer
+	timer = time.AfterFunc(messengerTypingTimeout, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		// Indicator was stopped or started again in the meantime
+		if t.timers[dialog] != timer {
+			return
+		}
+
+		t.hide(dialog)
+	})
+	t.timers[dialog] = timer
+
+	if !ok {
+		t.emit("typing_start", dialog)
+	}
+}
+
+// Hide the indicator from other members of the dialog
+func (t *messengerTyping) stop(dialog uint) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	timer, ok := t.timers[dialog]
+	if !ok {
+		return
+	}
+
+	timer.Stop()
+	t.hide(dialog)
+}
+
+// Hide every indicator of the connection, when it is closed
+func (t *messengerTyping) stopAll() {
+	t.mutex.Lock()
+	dialogs := make([]uint, 0, len(t.timers))
+	for dialog := range t.timers {
+		dialogs = append(dialogs, dialog)
+	}
+	t.mutex.Unlock()
+
+	for _, dialog := range dialogs {
+		t.stop(dialog)
+	}
+}
+
+func (t *messengerTyping) hide(dialog uint) {
+	delete(t.timers, dialog)
+	t.emit("typing_stop", dialog)
+}
+
+func (t *messengerTyping) emit(event string, dialog uint) {
+	// Skip own connections and users on either side of a block
+	except := []string{strconv.Itoa(t.user)}
+	for _, user := range controller.UserBlockIds(t.user) {
+		except = append(except, strconv.Itoa(user))
+	}
+
+	socketio.EmitExcept(
+		controller.MessengerDialogRoom(dialog),
+		except,
+		event,
+		controller.MessengerTyping{
+			Dialog: dialog,
+			User:   t.user,
+		},
+	)
+}
@@ -25,7 +25,8 @@ func Init(app *fiber.App) *socket.Server {
 	options.SetAllowEIO3(true)
 	options.SetPingInterval(300 * time.Millisecond)
 	options.SetPingTimeout(200 * time.Millisecond)
-	options.SetMaxHttpBufferSize(100000000)
+	// Media goes through REST uploads, socket payloads only carry small inline images
+	options.SetMaxHttpBufferSize(1000000)
 	options.SetConnectTimeout(1000 * time.Millisecond)
 	options.SetAdapter(&adapter.RedisAdapterBuilder{
 		Redis: r_type.NewRedisClient(context.Background(), database.Redis[1]),
@@ -68,3 +69,22 @@ func Broadcast(event string, message any) {
 func Emit(id string, event string, message any) {
 	server.To(socket.Room(id)).Emit(event, message)
 }
+
+// Emit to the room, skipping connections of the users
+func EmitExcept(room string, except []string, event string, message any) {
+	rooms := []socket.Room{}
+	for _, id := range except {
+		rooms = append(rooms, socket.Room(id))
+	}
+	server.To(socket.Room(room)).Except(rooms...).Emit(event, message)
+}
+
+// Subscribe every connection of the user to the room, on all nodes
+func Join(id string, room string) {
+	server.In(socket.Room(id)).SocketsJoin(socket.Room(room))
+}
+
+// Unsubscribe every connection of the user from the room, on all nodes
+func Leave(id string, room string) {
+	server.In(socket.Room(id)).SocketsLeave(socket.Room(room))
+}
@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Opus timestamps count samples at 48 kHz whatever the input rate was
+const OpusSampleRate = 48000
+
+// Max size of a packet in Ogg stream, comment headers may carry cover art
+const oggPacketSize = 1024 * 1024
+
+var (
+	ErrAudioInvalid  = errors.New("invalid ogg opus audio")
+	ErrAudioDuration = errors.New("audio is too long")
+)
+
+// Opus audio read from Ogg container
+type OggOpus struct {
+	Channels int
+	Duration time.Duration
+	Packets  []OpusPacket
+}
+
+// Audio packet with its size in bytes and duration in samples
+type OpusPacket struct {
+	Size    int
+	Samples int
+}
+
+// Validate the Ogg container with single Opus stream and read its packets,
+// audio longer than durationMax is rejected once it is reached, 0 for no limit
+func OggOpusRead(content io.Reader, durationMax time.Duration) (OggOpus, error) {
+	reader := bufio.NewReader(content)
+	audio := OggOpus{}
+
+	var (
+		serial     uint32
+		sequence   uint32
+		granule    int64 = -1
+		preSkip    int64
+		samples    int64
+		packets    int
+		packet     []byte
+		ended      bool
+		samplesMax = int64(durationMax.Seconds() * OpusSampleRate)
+	)
+
+	header := make([]byte, 27)
+	for page := 0; ; page++ {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return OggOpus{}, ErrAudioInvalid
+		}
+
+		flags := header[5]
+		if !bytes.Equal(header[:4], []byte("OggS")) || header[4] != 0 || ended {
+			return OggOpus{}, ErrAudioInvalid
+		}
+
+		// Single logical stream, chained and multiplexed streams are not supported
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		pageSequence := binary.LittleEndian.Uint32(header[18:22])
+		if page == 0 {
+			if flags&0x02 == 0 {
+				return OggOpus{}, ErrAudioInvalid
+			}
+			serial, sequence = pageSerial, pageSequence
+		} else if flags&0x02 != 0 || pageSerial != serial || pageSequence != sequence+1 {
+			return OggOpus{}, ErrAudioInvalid
+		}
+		sequence = pageSequence
+		ended = flags&0x04 != 0
+
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(reader, segments); err != nil {
+			return OggOpus{}, ErrAudioInvalid
+		}
+		size := 0
+		for _, segment := range segments {
+			size += int(segment)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return OggOpus{}, ErrAudioInvalid
+		}
+
+		checksum := binary.LittleEndian.Uint32(header[22:26])
+		binary.LittleEndian.PutUint32(header[22:26], 0)
+		if oggChecksum(oggChecksum(oggChecksum(0, header), segments), body) != checksum {
+			return OggOpus{}, ErrAudioInvalid
+		}
+
+		// Packet continued from the previous page exactly when the page says so
+		if (flags&0x01 != 0) != (packet != nil) {
+			return OggOpus{}, ErrAudioInvalid
+		}
+
+		completed := false
+		for _, segment := range segments {
+			packet = append(packet, body[:segment]...)
+			body = body[segment:]
+			if len(packet) > oggPacketSize {
+				return OggOpus{}, ErrAudioInvalid
+			}
+			if segment == 255 {
+				continue
+			}
+
+			switch packets {
+			case 0:
+				// Identification header: magic, version 0.x, channels, pre-skip
+				if len(packet) < 19 || !bytes.HasPrefix(packet, []byte("OpusHead")) || packet[8]>>4 != 0 || packet[9] == 0 {
+					return OggOpus{}, ErrAudioInvalid
+				}
+				audio.Channels = int(packet[9])
+				preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+			case 1:
+				if !bytes.HasPrefix(packet, []byte("OpusTags")) {
+					return OggOpus{}, ErrAudioInvalid
+				}
+			default:
+				duration := opusPacketSamples(packet)
+				if duration == 0 {
+					return OggOpus{}, ErrAudioInvalid
+				}
+				audio.Packets = append(audio.Packets, OpusPacket{Size: len(packet), Samples: duration})
+				samples += int64(duration)
+				if samplesMax > 0 && samples-preSkip > samplesMax {
+					return OggOpus{}, ErrAudioDuration
+				}
+			}
+			packets++
+			packet = nil
+			completed = true
+		}
+
+		if completed && packets > 2 {
+			granule = int64(binary.LittleEndian.Uint64(header[6:14]))
+		}
+	}
+
+	// The last granule position trims the padding of the last packet
+	if !ended || packet != nil || granule <= preSkip || granule > samples {
+		return OggOpus{}, ErrAudioInvalid
+	}
+
+	audio.Duration = time.Duration(float64(granule-preSkip) / OpusSampleRate * float64(time.Second))
+	return audio, nil
+}
+
+// Loudness envelope of the audio downsampled to the length, values are from 0 to 255;
+// voice is encoded with variable bitrate, the packet size per sample follows the loudness
+// so the audio is not decoded
+func OpusWaveform(packets []OpusPacket, length int) []int {
+	total := 0
+	for _, packet := range packets {
+		total += packet.Samples
+	}
+
+	length = min(length, len(packets))
+	sizes := make([]float64, length)
+	samples := make([]float64, length)
+	position := 0
+	for _, packet := range packets {
+		bucket := position * length / total
+		sizes[bucket] += float64(packet.Size)
+		samples[bucket] += float64(packet.Samples)
+		position += packet.Samples
+	}
+
+	peak := 0.0
+	for i := range sizes {
+		if samples[i] > 0 {
+			sizes[i] /= samples[i]
+		}
+		peak = max(peak, sizes[i])
+	}
+
+	waveform := make([]int, length)
+	for i := range sizes {
+		if peak > 0 {
+			waveform[i] = int(math.Round(sizes[i] / peak * 255))
+		}
+	}
+	return waveform
+}
+
+// Duration of the packet in samples from its TOC byte, 0 for malformed packet
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	// Frame size of the configuration: SILK, hybrid and CELT modes
+	config := int(packet[0] >> 3)
+	var frame int
+	switch {
+	case config < 12:
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		frame = []int{480, 960}[config%2]
+	default:
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+
+	// At most 120 ms of audio per packet
+	if frames == 0 || frames*frame > 5760 {
+		return 0
+	}
+	return frames * frame
+}
+
+var oggChecksumTable = func() [256]uint32 {
+	table := [256]uint32{}
+	for i := range table {
+		value := uint32(i) << 24
+		for range 8 {
+			if value&0x80000000 != 0 {
+				value = value<<1 ^ 0x04c11db7
+			} else {
+				value <<= 1
+			}
+		}
+		table[i] = value
+	}
+	return table
+}()
+
+// CRC-32 of Ogg pages, unlike IEEE it is not reflected
+func oggChecksum(checksum uint32, data []byte) uint32 {
+	for _, b := range data {
+		checksum = checksum<<8 ^ oggChecksumTable[byte(checksum>>24)^b]
+	}
+	return checksum
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Check value of the CRC-32 used by Ogg
+func TestOggChecksum(t *testing.T) {
+	if got := oggChecksum(0, []byte("123456789")); got != 0x89a1897f {
+		t.Errorf("checksum = %#x, want %#x", got, 0x89a1897f)
+	}
+}
+
+// Ogg page of the stream with the packets, each shorter than 255 bytes
+func oggPage(flags byte, granule int64, sequence uint32, packets [][]byte) []byte {
+	page := []byte("OggS\x00")
+	page = append(page, flags)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, 77)
+	page = binary.LittleEndian.AppendUint32(page, sequence)
+	page = binary.LittleEndian.AppendUint32(page, 0)
+	page = append(page, byte(len(packets)))
+	for _, packet := range packets {
+		page = append(page, byte(len(packet)))
+	}
+	for _, packet := range packets {
+		page = append(page, packet...)
+	}
+	binary.LittleEndian.PutUint32(page[22:26], oggChecksum(0, page))
+	return page
+}
+
+// Ogg Opus stream of count 20 ms packets, 50 per page, loud and quiet every half a second
+func oggOpus(count int) []byte {
+	head := append([]byte("OpusHead"), 1, 1, 0x38, 0x01, 0x80, 0xbb, 0, 0, 0, 0, 0)
+	tags := append([]byte("OpusTags"), make([]byte, 8)...)
+	stream := oggPage(0x02, 0, 0, [][]byte{head})
+	stream = append(stream, oggPage(0, 0, 1, [][]byte{tags})...)
+
+	sequence := uint32(2)
+	var granule int64
+	var packets [][]byte
+	for i := range count {
+		size := 80
+		if i/25%2 == 1 {
+			size = 10
+		}
+		packet := make([]byte, size)
+		packet[0] = 31 << 3
+		packets = append(packets, packet)
+		granule += 960
+
+		if len(packets) == 50 || i == count-1 {
+			flags := byte(0)
+			if i == count-1 {
+				// The last packet is padded
+				flags, granule = 0x04, granule-100
+			}
+			stream = append(stream, oggPage(flags, granule, sequence, packets)...)
+			sequence++
+			packets = nil
+		}
+	}
+	return stream
+}
+
+func TestOggOpusRead(t *testing.T) {
+	audio, err := OggOpusRead(bytes.NewReader(oggOpus(250)), 10*time.Second)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if audio.Channels != 1 {
+		t.Errorf("channels = %d, want 1", audio.Channels)
+	}
+	if len(audio.Packets) != 250 {
+		t.Errorf("packets = %d, want 250", len(audio.Packets))
+	}
+	// 250 packets of 960 samples without the padding and the pre-skip of 312 samples
+	samples := 250*960 - 100 - 312
+	if expected := time.Duration(float64(samples) / OpusSampleRate * float64(time.Second)); audio.Duration != expected {
+		t.Errorf("duration = %v, want %v", audio.Duration, expected)
+	}
+
+	corrupt := oggOpus(250)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if _, err := OggOpusRead(bytes.NewReader(corrupt), 0); err != ErrAudioInvalid {
+		t.Errorf("bad checksum: err = %v, want %v", err, ErrAudioInvalid)
+	}
+
+	truncated := oggOpus(250)
+	truncated = truncated[:len(truncated)-20]
+	if _, err := OggOpusRead(bytes.NewReader(truncated), 0); err != ErrAudioInvalid {
+		t.Errorf("truncated page: err = %v, want %v", err, ErrAudioInvalid)
+	}
+
+	if _, err := OggOpusRead(bytes.NewReader(oggOpus(1000)), 10*time.Second); err != ErrAudioDuration {
+		t.Errorf("20 s of audio: err = %v, want %v", err, ErrAudioDuration)
+	}
+	if _, err := OggOpusRead(bytes.NewReader(oggOpus(1000)), 0); err != nil {
+		t.Errorf("20 s of audio without limit: %v", err)
+	}
+}
+
+func TestOpusWaveform(t *testing.T) {
+	audio, err := OggOpusRead(bytes.NewReader(oggOpus(250)), 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	for _, length := range []int{1, 10, 100, 250, 1000} {
+		waveform := OpusWaveform(audio.Packets, length)
+		if len(waveform) != min(length, 250) {
+			t.Errorf("length %d: got %d values, want %d", length, len(waveform), min(length, 250))
+		}
+		for i, value := range waveform {
+			if value < 0 || value > 255 {
+				t.Errorf("length %d: value %d = %d, out of 0 to 255", length, i, value)
+			}
+		}
+	}
+
+	// Loud packets reach the peak, quiet ones are an eighth of it
+	waveform := OpusWaveform(audio.Packets, 10)
+	for i, value := range waveform {
+		expected := 255
+		if i%2 == 1 {
+			expected = 32
+		}
+		if value != expected {
+			t.Errorf("value %d = %d, want %d", i, value, expected)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Quality of encoded JPEG images
+const ImageJpegQuality = 85
+
+var ErrImageUnsupported = errors.New("unsupported image")
+
+// Decode PNG, JPEG, GIF or WebP image up to the number of pixels,
+// JPEG images are turned upright according to their EXIF orientation
+func ImageDecode(raw []byte, pixelsMax int) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil || config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > pixelsMax {
+		return nil, "", ErrImageUnsupported
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", ErrImageUnsupported
+	}
+
+	if format == "jpeg" {
+		src = ImageOrient(src, ImageOrientation(raw))
+	}
+
+	return src, format, nil
+}
+
+// Encode the image as PNG or JPEG, without format JPEG is used
+// for opaque images and PNG for the rest; returns MIME type of the result
+func ImageEncode(src image.Image, format string) ([]byte, string, error) {
+	if format == "" {
+		format = "jpeg"
+		if opaque, ok := src.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+			format = "png"
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	if format == "jpeg" {
+		err := jpeg.Encode(buffer, src, &jpeg.Options{Quality: ImageJpegQuality})
+		return buffer.Bytes(), "image/jpeg", err
+	}
+	err := png.Encode(buffer, src)
+	return buffer.Bytes(), "image/png", err
+}
+
+// Crop the image to the centered square and scale it down to the size
+func ImageSquare(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Point{
+		X: bounds.Min.X + (bounds.Dx()-side)/2,
+		Y: bounds.Min.Y + (bounds.Dy()-side)/2,
+	})
+
+	size = min(size, side)
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// Scale the image down to fit the square of the size, smaller images are returned as is
+func ImageFit(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return src
+	}
+
+	width, height := size, size
+	if bounds.Dx() > bounds.Dy() {
+		height = max(1, bounds.Dy()*size/bounds.Dx())
+	} else {
+		width = max(1, bounds.Dx()*size/bounds.Dy())
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
+
+// Turn the image upright according to the EXIF orientation from 1 to 8
+func ImageOrient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], rgba.Pix[rgba.PixOffset(sx, sy):rgba.PixOffset(sx, sy)+4])
+		}
+	}
+
+	return dst
+}
+
+// Orientation from the EXIF block of a JPEG image, 1 when it is missing
+func ImageOrientation(raw []byte) int {
+	if len(raw) < 4 || raw[0] != 0xFF || raw[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(raw); {
+		if raw[i] != 0xFF {
+			return 1
+		}
+
+		marker := raw[i+1]
+		switch {
+		case marker == 0xFF:
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7:
+			i += 2
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(raw[i+2:]))
+		if length < 2 || i+2+length > len(raw) {
+			return 1
+		}
+
+		segment := raw[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// Orientation tag of the first IFD of the TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"messenger-service/config"
+)
+
+// Key of url signatures, see UrlSignatureInit
+var urlSignatureKey []byte
+
+// Read the key of url signatures once at startup, the service does not run without it
+func UrlSignatureInit() {
+	key := config.Config("MEDIA_URL_KEY")
+	if key == "" {
+		panic("MEDIA_URL_KEY is not set")
+	}
+	urlSignatureKey = []byte(key)
+}
+
+// Sign the path until the expiry time, returns query string with expires and signature
+func SignUrl(path string, expires int64) string {
+	return "expires=" + strconv.FormatInt(expires, 10) + "&signature=" + urlSignature(path, expires)
+}
+
+// Check the signature of the path made by SignUrl and its expiry time,
+// nothing passes until the key is read by UrlSignatureInit
+func CheckUrlSignature(path string, expires string, signature string) bool {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if len(urlSignatureKey) == 0 || err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(urlSignature(path, expiresAt)))
+}
+
+func urlSignature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, urlSignatureKey)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Random identifier safe to expose in urls
+func RandomId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}